@@ -2,27 +2,91 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	pb "github.com/zubrodin/calc-service/internal/grpc"
+	"github.com/zubrodin/calc-service/pkg/calculator"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 func main() {
-	orchestratorAddr := os.Getenv("ORCHESTRATOR_ADDRESS")
-	if orchestratorAddr == "" {
-		orchestratorAddr = "localhost:50051"
+	defaultAddr := os.Getenv("ORCHESTRATOR_ADDRESS")
+	if defaultAddr == "" {
+		defaultAddr = "localhost:50051"
 	}
 
-	conn, err := grpc.Dial(orchestratorAddr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	defaultPower := runtime.NumCPU()
+	if v := os.Getenv("COMPUTING_POWER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid COMPUTING_POWER %q", v)
+		}
+		defaultPower = n
+	}
+
+	defaultHeartbeat := 5 * time.Second
+	if v := os.Getenv("HEARTBEAT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid HEARTBEAT_INTERVAL %q", v)
+		}
+		defaultHeartbeat = d
+	}
+
+	orchestratorAddr := flag.String("orchestrator", defaultAddr, "orchestrator gRPC address")
+	computingPower := flag.Int("computing-power", defaultPower, "number of parallel workers")
+	heartbeat := flag.Duration("heartbeat", defaultHeartbeat, "interval between heartbeats")
+	tlsEnabled := flag.Bool("tls", os.Getenv("ORCHESTRATOR_TLS") == "true", "connect to the orchestrator over TLS")
+	tlsCA := flag.String("tls-ca", os.Getenv("ORCHESTRATOR_TLS_CA"), "CA certificate verifying the orchestrator")
+	tlsCert := flag.String("tls-cert", os.Getenv("AGENT_TLS_CERT"), "client certificate for mTLS")
+	tlsKey := flag.String("tls-key", os.Getenv("AGENT_TLS_KEY"), "client certificate key for mTLS")
+	flag.Parse()
+
+	if *computingPower < 1 {
+		log.Fatalf("computing power must be at least 1, got %d", *computingPower)
+	}
+
+	opts := []grpc.DialOption{
 		grpc.WithBlock(),
-		grpc.WithTimeout(5*time.Second))
+		grpc.WithTimeout(5 * time.Second),
+	}
+
+	secure := *tlsEnabled || *tlsCA != "" || *tlsCert != ""
+	if secure {
+		creds, err := transportCredentials(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("invalid TLS configuration: %v", err)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	// The token is only read from the environment so that it does not show
+	// up in the process list.
+	if token := os.Getenv("AGENT_TOKEN"); token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: token, secure: secure}))
+	}
+
+	conn, err := grpc.Dial(*orchestratorAddr, opts...)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
@@ -30,61 +94,312 @@ func main() {
 
 	client := pb.NewCalculatorClient(conn)
 
+	// On SIGINT/SIGTERM workers stop taking new tasks but finish the ones
+	// they are computing.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "agent"
+	}
+
+	a := &agent{
+		client:    client,
+		id:        agentID(hostname),
+		hostname:  hostname,
+		capacity:  *computingPower,
+		heartbeat: *heartbeat,
+	}
+
+	log.Printf("Agent %s started with %d workers", a.id, a.capacity)
+
+	var b backoff
 	for {
-		task, err := client.GetTask(context.Background(), &pb.TaskRequest{})
-		if err != nil {
-			log.Printf("Error getting task: %v", err)
-			time.Sleep(5 * time.Second)
-			continue
+		started := time.Now()
+		err := a.session(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if time.Since(started) > maxBackoff {
+			b.reset()
+		}
+		delay, ok := b.next(err)
+		if !ok {
+			log.Fatalf("Orchestrator rejected agent %s: %v", a.id, err)
+		}
+		if code := status.Code(err); code == codes.Unauthenticated || code == codes.PermissionDenied {
+			log.Printf("Orchestrator refused the credentials of agent %s: %v; check AGENT_TOKEN, retrying in %s", a.id, err, delay)
+		} else {
+			log.Printf("Connection to orchestrator lost: %v; reconnecting in %s", err, delay)
+		}
+		sleep(ctx, delay)
+	}
+
+	log.Printf("Agent %s stopped", a.id)
+}
+
+type agent struct {
+	client    pb.CalculatorClient
+	id        string
+	hostname  string
+	capacity  int
+	heartbeat time.Duration
+}
+
+// session serves one Connect stream: the orchestrator pushes tasks into the
+// free worker slots and the results go back on the same stream. When ctx is
+// canceled the agent asks the orchestrator to stop sending tasks, finishes
+// the ones it already holds and closes the stream.
+func (a *agent) session(ctx context.Context) error {
+	// The stream outlives ctx so that results of in-flight tasks can still
+	// be delivered during shutdown.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := a.client.Connect(streamCtx)
+	if err != nil {
+		return err
+	}
+
+	var sendMu sync.Mutex
+	send := func(msg *pb.WorkerMessage) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(msg)
+	}
+
+	if err := send(&pb.WorkerMessage{Payload: &pb.WorkerMessage_Hello{Hello: &pb.WorkerHello{
+		WorkerId: a.id,
+		Capacity: int32(a.capacity),
+		Hostname: a.hostname,
+	}}}); err != nil {
+		return err
+	}
+	if err := send(&pb.WorkerMessage{Payload: &pb.WorkerMessage_Ready{Ready: int32(a.capacity)}}); err != nil {
+		return err
+	}
+
+	var (
+		inFlight sync.WaitGroup
+		draining atomic.Bool
+	)
+	tasks := make(chan *pb.TaskResponse, a.capacity)
+	drained := make(chan struct{})
+	recvErr := make(chan error, 1)
+
+	go func() {
+		defer close(tasks)
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			switch p := msg.Payload.(type) {
+			case *pb.ServerMessage_Task:
+				inFlight.Add(1)
+				tasks <- p.Task
+			case *pb.ServerMessage_Drained:
+				close(drained)
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(a.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-streamCtx.Done():
+				return
+			case <-ticker.C:
+				if err := send(&pb.WorkerMessage{Payload: &pb.WorkerMessage_Heartbeat{Heartbeat: true}}); err != nil {
+					return
+				}
+			}
 		}
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < a.capacity; i++ {
+		workers.Add(1)
+		go func(n int) {
+			defer workers.Done()
+			for task := range tasks {
+				if err := send(a.process(n, task)); err != nil {
+					log.Printf("Worker %d: error sending result of %s: %v", n, task.Id, err)
+				} else if !draining.Load() {
+					if err := send(&pb.WorkerMessage{Payload: &pb.WorkerMessage_Ready{Ready: 1}}); err != nil {
+						log.Printf("Worker %d: error requesting task: %v", n, err)
+					}
+				}
+				inFlight.Done()
+			}
+		}(i)
+	}
+	defer workers.Wait()
+
+	select {
+	case err := <-recvErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	draining.Store(true)
+	if err := send(&pb.WorkerMessage{Payload: &pb.WorkerMessage_Drain{Drain: true}}); err != nil {
+		return err
+	}
+
+	// After the acknowledgement no more tasks arrive, so once the held ones
+	// are done the stream can be closed.
+	select {
+	case <-drained:
+	case err := <-recvErr:
+		return err
+	}
+	inFlight.Wait()
+
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	if err := <-recvErr; err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// process computes a task and builds the message reporting its outcome.
+func (a *agent) process(n int, task *pb.TaskResponse) *pb.WorkerMessage {
+	// Simulates an expensive operation as configured on the orchestrator.
+	time.Sleep(time.Duration(task.OperationTimeMs) * time.Millisecond)
+
+	result, err := calculate(task)
+	if err != nil {
+		log.Printf("Worker %d: calculation error: %v", n, err)
+		return &pb.WorkerMessage{Payload: &pb.WorkerMessage_Error{Error: &pb.ErrorRequest{
+			Id:       task.Id,
+			Error:    err.Error(),
+			WorkerId: a.id,
+		}}}
+	}
+
+	return &pb.WorkerMessage{Payload: &pb.WorkerMessage_Result{Result: &pb.ResultRequest{
+		Id:       task.Id,
+		Value:    result,
+		WorkerId: a.id,
+	}}}
+}
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// backoff decides how long to wait before reconnecting to the orchestrator.
+type backoff struct {
+	attempt int
+}
 
-		if task.Id == "" {
-			time.Sleep(1 * time.Second)
-			continue
+// next returns the delay after a session ended with err, or false if
+// reconnecting cannot help because the orchestrator rejected the agent's
+// requests themselves. An unavailable orchestrator is retried with an
+// exponentially growing delay unless it suggests one in RetryInfo. Refused
+// credentials are retried the same way, since the orchestrator may be in
+// the middle of rotating agent tokens.
+func (b *backoff) next(err error) (time.Duration, bool) {
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.InvalidArgument, codes.Unimplemented:
+		return 0, false
+	case codes.Unavailable, codes.ResourceExhausted, codes.PermissionDenied, codes.Unauthenticated:
+		for _, detail := range st.Details() {
+			if info, ok := detail.(*errdetails.RetryInfo); ok {
+				return info.RetryDelay.AsDuration(), true
+			}
 		}
+		d := minBackoff << b.attempt
+		if d >= maxBackoff {
+			return maxBackoff, true
+		}
+		b.attempt++
+		return d, true
+	default:
+		return 5 * time.Second, true
+	}
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
 
-		result, err := calculate(task)
+// transportCredentials configures TLS to the orchestrator. Without a CA
+// file the system roots are used; a client certificate enables mTLS.
+func transportCredentials(caFile, certFile, keyFile string) (credentials.TransportCredentials, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
 		if err != nil {
-			log.Printf("Calculation error: %v", err)
-			continue
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
 		}
+		tlsConfig.RootCAs = pool
+	}
 
-		_, err = client.SubmitResult(context.Background(), &pb.ResultRequest{
-			Id:     task.Id,
-			Result: result,
-		})
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("client certificate and key must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
-			log.Printf("Error submitting result: %v", err)
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
 		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
-		time.Sleep(500 * time.Millisecond)
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// tokenCredentials sends the agent token with every call.
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return c.secure
+}
+
+// sleep waits for d or until ctx is canceled.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
 	}
 }
 
-func calculate(task *pb.TaskResponse) (float64, error) {
-	arg1, err := strconv.ParseFloat(task.Arg1, 64)
-	if err != nil {
-		return 0, fmt.Errorf("invalid arg1: %w", err)
+// agentID identifies this agent process to the orchestrator.
+func agentID(hostname string) string {
+	if id := os.Getenv("AGENT_ID"); id != "" {
+		return id
 	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
 
-	arg2, err := strconv.ParseFloat(task.Arg2, 64)
+func calculate(task *pb.TaskResponse) (string, error) {
+	mode, err := calculator.ParseMode(task.Mode)
 	if err != nil {
-		return 0, fmt.Errorf("invalid arg2: %w", err)
-	}
-
-	switch task.Operation {
-	case "+":
-		return arg1 + arg2, nil
-	case "-":
-		return arg1 - arg2, nil
-	case "*":
-		return arg1 * arg2, nil
-	case "/":
-		if arg2 == 0 {
-			return 0, fmt.Errorf("division by zero")
-		}
-		return arg1 / arg2, nil
-	default:
-		return 0, fmt.Errorf("unknown operation: %s", task.Operation)
+		return "", err
 	}
+	return calculator.Apply(mode, task.Operation, task.Args)
 }
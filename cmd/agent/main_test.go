@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/zubrodin/calc-service/internal/grpc"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// fakeOrchestrator hands every Connect stream to the test, which then plays
+// the orchestrator side. The stream ends with the error sent on end.
+type fakeOrchestrator struct {
+	pb.UnimplementedCalculatorServer
+	streams chan pb.Calculator_ConnectServer
+	end     chan error
+}
+
+func (f *fakeOrchestrator) Connect(stream pb.Calculator_ConnectServer) error {
+	f.streams <- stream
+	select {
+	case err := <-f.end:
+		return err
+	case <-stream.Context().Done():
+		return stream.Context().Err()
+	}
+}
+
+func newTestAgent(t *testing.T, capacity int) (*agent, *fakeOrchestrator) {
+	t.Helper()
+	f := &fakeOrchestrator{
+		streams: make(chan pb.Calculator_ConnectServer, 1),
+		end:     make(chan error, 1),
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterCalculatorServer(srv, f)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &agent{
+		client:    pb.NewCalculatorClient(conn),
+		id:        "agent-1",
+		capacity:  capacity,
+		heartbeat: time.Hour,
+	}, f
+}
+
+// receiver reads the agent messages of a stream in the background.
+type receiver struct {
+	messages chan *pb.WorkerMessage
+	err      chan error
+}
+
+func receive(stream pb.Calculator_ConnectServer) *receiver {
+	r := &receiver{messages: make(chan *pb.WorkerMessage, 16), err: make(chan error, 1)}
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				r.err <- err
+				return
+			}
+			r.messages <- msg
+		}
+	}()
+	return r
+}
+
+func (r *receiver) next(t *testing.T) *pb.WorkerMessage {
+	t.Helper()
+	select {
+	case msg := <-r.messages:
+		return msg
+	case err := <-r.err:
+		t.Fatalf("Recv() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message from the agent")
+	}
+	return nil
+}
+
+func (f *fakeOrchestrator) accept(t *testing.T) (pb.Calculator_ConnectServer, *receiver) {
+	t.Helper()
+	var stream pb.Calculator_ConnectServer
+	select {
+	case stream = <-f.streams:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not connect")
+	}
+	r := receive(stream)
+	if hello := r.next(t).GetHello(); hello == nil || hello.WorkerId != "agent-1" {
+		t.Fatalf("first message = %v, want a hello from agent-1", hello)
+	}
+	return stream, r
+}
+
+func sendTask(t *testing.T, stream pb.Calculator_ConnectServer, task *pb.TaskResponse) {
+	t.Helper()
+	if err := stream.Send(&pb.ServerMessage{Payload: &pb.ServerMessage_Task{Task: task}}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	a, f := newTestAgent(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- a.session(ctx) }()
+
+	stream, r := f.accept(t)
+	if msg := r.next(t); msg.GetReady() != 2 {
+		t.Fatalf("message = %v, want 2 free slots", msg)
+	}
+
+	sendTask(t, stream, &pb.TaskResponse{Id: "a", Args: []string{"1/3", "1/6"}, Operation: "+", Mode: "decimal"})
+	sendTask(t, stream, &pb.TaskResponse{Id: "b", Args: []string{"1", "0"}, Operation: "/"})
+	results := make(map[string]string)
+	errors := make(map[string]string)
+	slots := 0
+	for len(results)+len(errors) < 2 || slots < 2 {
+		msg := r.next(t)
+		switch p := msg.Payload.(type) {
+		case *pb.WorkerMessage_Result:
+			if p.Result.WorkerId != "agent-1" {
+				t.Errorf("result of %s from worker %q, want agent-1", p.Result.Id, p.Result.WorkerId)
+			}
+			results[p.Result.Id] = p.Result.Value
+		case *pb.WorkerMessage_Error:
+			errors[p.Error.Id] = p.Error.Error
+		case *pb.WorkerMessage_Ready:
+			slots += int(p.Ready)
+		default:
+			t.Fatalf("message = %v, want a result or a free slot", msg)
+		}
+	}
+	if results["a"] != "1/2" || errors["b"] != "division by zero" {
+		t.Errorf("results = %v, errors = %v, want a = 1/2, b: division by zero", results, errors)
+	}
+
+	// On shutdown the agent drains: the task it holds is still computed and
+	// reported, but no more slots are granted.
+	sendTask(t, stream, &pb.TaskResponse{Id: "c", Args: []string{"2", "3"}, Operation: "*", OperationTimeMs: 100})
+	cancel()
+	if msg := r.next(t); !msg.GetDrain() {
+		t.Fatalf("message = %v, want a drain request", msg)
+	}
+	if err := stream.Send(&pb.ServerMessage{Payload: &pb.ServerMessage_Drained{Drained: true}}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if msg := r.next(t); msg.GetResult().GetId() != "c" || msg.GetResult().GetValue() != "6" {
+		t.Fatalf("message = %v, want the result of c", msg)
+	}
+	select {
+	case err := <-r.err:
+		if err != io.EOF {
+			t.Fatalf("Recv() error = %v, want %v", err, io.EOF)
+		}
+	case msg := <-r.messages:
+		t.Fatalf("message = %v after the drain, want the stream closed", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not close the stream")
+	}
+	f.end <- nil
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("session() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not return")
+	}
+}
+
+func TestSessionStreamError(t *testing.T) {
+	a, f := newTestAgent(t, 1)
+	done := make(chan error, 1)
+	go func() { done <- a.session(context.Background()) }()
+
+	f.accept(t)
+	f.end <- status.Error(codes.Unavailable, "orchestrator is shutting down")
+
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("session() error = %v, want code %v", err, codes.Unavailable)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not return")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	retryAfter, err := status.New(codes.Unavailable, "database is busy").WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(3 * time.Second),
+	})
+	if err != nil {
+		t.Fatalf("WithDetails() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantDelay time.Duration
+		wantOK    bool
+	}{
+		{"rejected", []error{status.Error(codes.InvalidArgument, "no")}, 0, false},
+		{"refused credentials", []error{status.Error(codes.Unauthenticated, "no")}, minBackoff, true},
+		{"refused worker", []error{
+			status.Error(codes.PermissionDenied, "no"),
+			status.Error(codes.PermissionDenied, "no"),
+		}, 2 * minBackoff, true},
+		{"unavailable", []error{status.Error(codes.Unavailable, "down")}, minBackoff, true},
+		{"growing", []error{
+			status.Error(codes.Unavailable, "down"),
+			status.Error(codes.Unavailable, "down"),
+			status.Error(codes.Unavailable, "down"),
+		}, 4 * minBackoff, true},
+		{"capped", []error{
+			status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down"),
+			status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down"),
+			status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down"),
+		}, maxBackoff, true},
+		{"retry info", []error{retryAfter.Err()}, 3 * time.Second, true},
+		{"other", []error{io.ErrUnexpectedEOF}, 5 * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				b     backoff
+				delay time.Duration
+				ok    bool
+			)
+			for _, err := range tt.errs {
+				delay, ok = b.next(err)
+			}
+			if delay != tt.wantDelay || ok != tt.wantOK {
+				t.Errorf("next() = %v, %v, want %v, %v", delay, ok, tt.wantDelay, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTokenCredentials(t *testing.T) {
+	c := tokenCredentials{token: "secret", secure: true}
+	md, err := c.GetRequestMetadata(context.Background())
+	if err != nil {
+		t.Fatalf("GetRequestMetadata() error = %v", err)
+	}
+	if md["authorization"] != "Bearer secret" {
+		t.Errorf("authorization = %q, want %q", md["authorization"], "Bearer secret")
+	}
+	if !c.RequireTransportSecurity() {
+		t.Error("RequireTransportSecurity() = false for a TLS connection")
+	}
+}
+
+func TestTransportCredentialsErrors(t *testing.T) {
+	if _, err := transportCredentials("", "client.crt", ""); err == nil {
+		t.Error("transportCredentials() without a key error = nil")
+	}
+	if _, err := transportCredentials(filepath.Join(t.TempDir(), "missing.crt"), "", ""); err == nil {
+		t.Error("transportCredentials() with a missing CA error = nil")
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		task    *pb.TaskResponse
+		want    string
+		wantErr bool
+	}{
+		{&pb.TaskResponse{Args: []string{"7", "2"}, Operation: "-"}, "5", false},
+		{&pb.TaskResponse{Args: []string{"7", "2"}, Operation: "/"}, "3.5", false},
+		{&pb.TaskResponse{Args: []string{"7", "0"}, Operation: "/"}, "", true},
+		{&pb.TaskResponse{Args: []string{"x", "2"}, Operation: "+"}, "", true},
+		{&pb.TaskResponse{Args: []string{"7", "2"}, Operation: "%"}, "1", false},
+		{&pb.TaskResponse{Args: []string{"-7", "2"}, Operation: "%"}, "1", false},
+		{&pb.TaskResponse{Args: []string{"7", "-2"}, Operation: "%"}, "-1", false},
+		{&pb.TaskResponse{Args: []string{"7", "0"}, Operation: "%"}, "", true},
+		{&pb.TaskResponse{Args: []string{"7", "2"}, Operation: "//"}, "3", false},
+		{&pb.TaskResponse{Args: []string{"-7", "2"}, Operation: "//"}, "-4", false},
+		{&pb.TaskResponse{Args: []string{"7", "0"}, Operation: "//"}, "", true},
+		{&pb.TaskResponse{Args: []string{"2", "10"}, Operation: "^"}, "1024", false},
+		{&pb.TaskResponse{Args: []string{"7", "2"}, Operation: "&"}, "", true},
+		{&pb.TaskResponse{Args: []string{"16"}, Operation: "sqrt"}, "4", false},
+		{&pb.TaskResponse{Args: []string{"-1"}, Operation: "sqrt"}, "", true},
+		{&pb.TaskResponse{Args: []string{"8", "2"}, Operation: "log"}, "3", false},
+		{&pb.TaskResponse{Args: []string{"1", "5"}, Operation: "max"}, "5", false},
+		{&pb.TaskResponse{Args: []string{"1", "2"}, Operation: "sqrt"}, "", true},
+		{&pb.TaskResponse{Args: []string{"10", "1"}, Operation: "^"}, "10", false},
+		{&pb.TaskResponse{Args: []string{"1e308", "10"}, Operation: "*"}, "", true},
+		{&pb.TaskResponse{Args: []string{"1/3", "1/6"}, Operation: "+", Mode: "decimal"}, "1/2", false},
+		{&pb.TaskResponse{Args: []string{"0.1", "0.2"}, Operation: "+", Mode: "decimal"}, "3/10", false},
+		{&pb.TaskResponse{Args: []string{"1", "0"}, Operation: "/", Mode: "decimal"}, "", true},
+		{&pb.TaskResponse{Args: []string{"1+1i", "1-1i"}, Operation: "*", Mode: "complex"}, "2", false},
+		{&pb.TaskResponse{Args: []string{"-1"}, Operation: "sqrt", Mode: "complex"}, "1i", false},
+		{&pb.TaskResponse{Args: []string{"1", "2"}, Operation: "+", Mode: "exact"}, "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := calculate(tt.task)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("calculate(%v) error = %v, wantErr %v", tt.task, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("calculate(%v) = %q, want %q", tt.task, got, tt.want)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
-	"net"
-	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/zubrodin/calc-service/internal/app"
 	"github.com/zubrodin/calc-service/internal/config"
@@ -17,25 +19,27 @@ func main() {
 
 	application := app.New(cfg)
 
-	// Запуск HTTP сервера
-	go func() {
-		router := application.SetupRouter()
-		log.Printf("Starting HTTP server on %s", cfg.ServerAddress)
-		if err := http.ListenAndServe(cfg.ServerAddress, router); err != nil {
-			log.Fatalf("Failed to start HTTP server: %v", err)
-		}
-	}()
-
-	// Запуск gRPC сервера
-	lis, err := net.Listen("tcp", cfg.GrpcAddress)
-	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := application.Start(ctx); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+
+	// Ожидание сигнала остановки или ошибки одного из серверов
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+	case err := <-application.Err():
+		log.Printf("Server failed: %v", err)
 	}
+	stop()
 
-	grpcServer := application.GRPCHandler()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
 
-	log.Printf("Starting gRPC server on %s", cfg.GrpcAddress)
-	if err := grpcServer.Serve(lis); err != nil {
-		log.Fatalf("failed to serve gRPC: %v", err)
+	if err := application.Stop(shutdownCtx); err != nil {
+		log.Fatalf("Failed to stop: %v", err)
 	}
+	log.Printf("Stopped")
 }
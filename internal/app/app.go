@@ -2,10 +2,14 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sync"
 
+	"github.com/zubrodin/calc-service/internal/auth"
 	"github.com/zubrodin/calc-service/internal/config"
 	pb "github.com/zubrodin/calc-service/internal/grpc"
 	"github.com/zubrodin/calc-service/internal/handler"
@@ -16,76 +20,200 @@ import (
 	"google.golang.org/grpc"
 )
 
-type calculatorServer struct {
-	pb.UnimplementedCalculatorServer
+type App struct {
+	config  *config.Config
+	handler *handler.Handler
 	service *service.Service
 	repo    repository.Repository
+
+	httpServer *http.Server
+	grpcServer *grpc.Server
+	shutdown   chan struct{}
+	stopReaper context.CancelFunc
+	background sync.WaitGroup
+	errs       chan error
 }
 
-func (s *calculatorServer) GetTask(ctx context.Context, req *pb.TaskRequest) (*pb.TaskResponse, error) {
-	task, err := s.repo.GetPendingTask()
+func New(cfg *config.Config) *App {
+	credentials, err := validator.NewCredentials(validator.CredentialRules{
+		LoginMinLength:        cfg.LoginMinLength,
+		LoginMaxLength:        cfg.LoginMaxLength,
+		LoginPattern:          cfg.LoginPattern,
+		PasswordMinLength:     cfg.PasswordMinLength,
+		PasswordMaxLength:     cfg.PasswordMaxLength,
+		PasswordRequireLower:  cfg.PasswordRequireLower,
+		PasswordRequireUpper:  cfg.PasswordRequireUpper,
+		PasswordRequireDigit:  cfg.PasswordRequireDigit,
+		PasswordRequireSymbol: cfg.PasswordRequireSymbol,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize credentials validator: %v", err)
+	}
+
+	calculator := calculator.New(calculator.WithImplicitMultiplication(cfg.ImplicitMultiplication))
+	validator := validator.New(calculator)
+
+	repo, err := repository.NewSQLiteRepository(cfg.DatabasePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get task: %w", err)
+		log.Fatalf("Failed to initialize repository: %v", err)
 	}
-	if task == nil {
-		return &pb.TaskResponse{}, nil
+
+	auth, err := auth.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize auth: %v", err)
 	}
 
-	return &pb.TaskResponse{
-		Id:        task.ID,
-		Arg1:      task.Arg1,
-		Arg2:      task.Arg2,
-		Operation: task.Operation,
-	}, nil
+	service := service.New(calculator, validator, repo)
+	handler := handler.New(service, repo, auth, credentials, cfg.WorkerTimeout, cfg.DecimalPrecision, cfg.AdminLogins)
+
+	return &App{
+		config:   cfg,
+		handler:  handler,
+		service:  service,
+		repo:     repo,
+		shutdown: make(chan struct{}),
+		errs:     make(chan error, 2),
+	}
 }
 
-func (s *calculatorServer) SubmitResult(ctx context.Context, req *pb.ResultRequest) (*pb.ResultResponse, error) {
-	if err := s.repo.SaveResult(req.Id, req.Result); err != nil {
-		return &pb.ResultResponse{Success: false}, fmt.Errorf("failed to save result: %w", err)
+// Start binds the HTTP and gRPC listeners and serves them in the background
+// together with the lease reaper. Errors of a running server are reported
+// on Err.
+func (a *App) Start(ctx context.Context) error {
+	var lc net.ListenConfig
+
+	httpListener, err := lc.Listen(ctx, "tcp", a.config.ServerAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", a.config.ServerAddress, err)
+	}
+	grpcListener, err := lc.Listen(ctx, "tcp", a.config.GrpcAddress)
+	if err != nil {
+		httpListener.Close()
+		return fmt.Errorf("failed to listen on %s: %w", a.config.GrpcAddress, err)
 	}
-	return &pb.ResultResponse{Success: true}, nil
+
+	a.httpServer = &http.Server{Handler: a.SetupRouter()}
+	a.grpcServer = a.GRPCHandler()
+
+	reaperCtx, stopReaper := context.WithCancel(context.Background())
+	a.stopReaper = stopReaper
+
+	a.background.Add(3)
+	go func() {
+		defer a.background.Done()
+		log.Printf("Starting HTTP server on %s", a.config.ServerAddress)
+		if err := a.httpServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
+			a.errs <- fmt.Errorf("HTTP server: %w", err)
+		}
+	}()
+	go func() {
+		defer a.background.Done()
+		log.Printf("Starting gRPC server on %s", a.config.GrpcAddress)
+		if err := a.grpcServer.Serve(grpcListener); err != nil {
+			a.errs <- fmt.Errorf("gRPC server: %w", err)
+		}
+	}()
+	go func() {
+		defer a.background.Done()
+		a.RunLeaseReaper(reaperCtx)
+	}()
+
+	return nil
 }
 
-type App struct {
-	config  *config.Config
-	handler *handler.Handler
-	service *service.Service
-	repo    repository.Repository
+// Err reports a server that stopped serving unexpectedly.
+func (a *App) Err() <-chan error {
+	return a.errs
 }
 
-func New(cfg *config.Config) *App {
-	validator := validator.New()
-	calculator := calculator.New()
+// Stop shuts the orchestrator down: the HTTP server stops accepting
+// requests and waits for the running ones, agents are given until ctx is
+// done to report the tasks they hold, leases that are still open are
+// returned to the queue, and the repository is closed.
+func (a *App) Stop(ctx context.Context) error {
+	var errs []error
 
-	repo, err := repository.NewSQLiteRepository(cfg.DatabasePath)
-	if err != nil {
-		log.Fatalf("Failed to initialize repository: %v", err)
+	if err := a.httpServer.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shut down HTTP server: %w", err))
 	}
 
-	service := service.New(calculator, validator, repo)
-	handler := handler.New(service, repo)
+	close(a.shutdown)
+	stopped := make(chan struct{})
+	go func() {
+		a.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Printf("Agents did not finish in time, closing their streams")
+		a.grpcServer.Stop()
+		<-stopped
+	}
 
-	return &App{
-		config:  cfg,
-		handler: handler,
-		service: service,
-		repo:    repo,
+	a.stopReaper()
+	a.background.Wait()
+
+	released, err := a.repo.ReleaseLeases()
+	if err != nil {
+		errs = append(errs, err)
+	} else if released > 0 {
+		log.Printf("Returned %d unfinished tasks to the queue", released)
+	}
+
+	if err := a.repo.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close repository: %w", err))
 	}
+
+	return errors.Join(errs...)
 }
 
 func (a *App) GRPCHandler() *grpc.Server {
-	s := grpc.NewServer()
+	var opts []grpc.ServerOption
+	if a.config.GRPCTLSCertFile != "" {
+		creds, err := grpcCredentials(a.config)
+		if err != nil {
+			log.Fatalf("Failed to initialize gRPC TLS: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	if authenticator := newAgentAuthenticator(a.config.AgentToken, a.config.AgentTokens); authenticator.enabled() {
+		opts = append(opts,
+			grpc.UnaryInterceptor(authenticator.unaryInterceptor),
+			grpc.StreamInterceptor(authenticator.streamInterceptor),
+		)
+	}
+
+	s := grpc.NewServer(opts...)
 	pb.RegisterCalculatorServer(s, &calculatorServer{
-		service: a.service,
-		repo:    a.repo,
+		service:        a.service,
+		repo:           a.repo,
+		leaseTimeout:   a.config.TaskLeaseTimeout,
+		operationTimes: a.config.OperationTimes,
+		functionTime:   a.config.FunctionTime,
+		shutdown:       a.shutdown,
+		sessions:       newSessions(),
 	})
 	return s
 }
 
+// RunLeaseReaper returns operations with expired leases to the queue
+// until ctx is canceled.
+func (a *App) RunLeaseReaper(ctx context.Context) {
+	a.service.ReapExpiredLeases(ctx, a.config.LeaseReaperInterval, a.config.TaskMaxAttempts)
+}
+
 func (a *App) SetupRouter() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/register", a.handler.Register)
 	mux.HandleFunc("/api/v1/login", a.handler.Login)
+	mux.HandleFunc("/api/v1/refresh", a.handler.Refresh)
+	mux.HandleFunc("/api/v1/logout", a.handler.Authenticate(a.handler.Logout))
 	mux.HandleFunc("/api/v1/calculate", a.handler.Authenticate(a.handler.Calculate))
+	mux.HandleFunc("/api/v1/expressions", a.handler.Authenticate(a.handler.ListExpressions))
+	mux.HandleFunc("/api/v1/expressions/{id}", a.handler.Authenticate(a.handler.GetExpression))
+	mux.HandleFunc("/api/v1/workers", a.handler.Authenticate(a.handler.RequireAdmin(a.handler.ListWorkers)))
+	mux.HandleFunc("/api/v1/variables", a.handler.Authenticate(a.handler.ListVariables))
+	mux.HandleFunc("/api/v1/variables/{name}", a.handler.Authenticate(a.handler.Variable))
 	return mux
 }
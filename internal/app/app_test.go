@@ -0,0 +1,225 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zubrodin/calc-service/internal/config"
+	pb "github.com/zubrodin/calc-service/internal/grpc"
+	"github.com/zubrodin/calc-service/internal/repository"
+	"github.com/zubrodin/calc-service/pkg/calculator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func startTestApp(t *testing.T) *App {
+	t.Helper()
+	a := New(&config.Config{
+		DatabasePath:        filepath.Join(t.TempDir(), "calc.db"),
+		ServerAddress:       freeAddr(t),
+		GrpcAddress:         freeAddr(t),
+		JWTKeys:             map[string]string{"k1": "secret"},
+		JWTActiveKeyID:      "k1",
+		JWTTTL:              time.Minute,
+		RefreshTTL:          time.Hour,
+		TaskLeaseTimeout:    time.Minute,
+		TaskMaxAttempts:     3,
+		LeaseReaperInterval: time.Second,
+		WorkerTimeout:       time.Minute,
+	})
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	return a
+}
+
+// agentClient connects to the gRPC server of a started App.
+func agentClient(t *testing.T, a *App) pb.CalculatorClient {
+	t.Helper()
+	conn, err := grpc.NewClient(a.config.GrpcAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewCalculatorClient(conn)
+}
+
+// stopApp runs Stop in the background.
+func stopApp(a *App, timeout time.Duration) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- a.Stop(ctx)
+	}()
+	return done
+}
+
+// stillRunning checks that Stop keeps waiting.
+func stillRunning(t *testing.T, done <-chan error, waitingFor string) {
+	t.Helper()
+	select {
+	case err := <-done:
+		t.Fatalf("Stop() = %v before %s", err, waitingFor)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func waitStopped(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Stop() error = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stop() did not return")
+	}
+}
+
+// reopen opens the database of a stopped App.
+func reopen(t *testing.T, a *App) *repository.SQLiteRepository {
+	t.Helper()
+	repo, err := repository.NewSQLiteRepository(a.config.DatabasePath)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestStop(t *testing.T) {
+	a := startTestApp(t)
+	id, err := a.service.Submit(testUserID, "2+3", calculator.ModeFloat)
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+
+	s := connectAgent(t, agentClient(t, a), "agent-1", 1)
+	s.ready(t, 1)
+	task := s.task(t)
+
+	// An HTTP request whose body has not fully arrived yet is in flight.
+	conn, err := net.Dial("tcp", a.config.ServerAddress)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	body := `{"login":"user1","password":"password123"}`
+	fmt.Fprintf(conn, "POST /api/v1/register HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", len(body))
+	fmt.Fprint(conn, body[:10])
+	time.Sleep(100 * time.Millisecond)
+
+	done := stopApp(a, 10*time.Second)
+	stillRunning(t, done, "the HTTP request finished")
+
+	fmt.Fprint(conn, body[10:])
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("register status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// The agent still holds a task, so its stream stays open until the
+	// result is reported.
+	stillRunning(t, done, "the agent reported its task")
+	s.result(t, task.Id, "5")
+	select {
+	case err := <-s.err:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("stream error = %v, want code %v", err, codes.Unavailable)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed")
+	}
+	waitStopped(t, done)
+
+	if _, err := a.repo.GetTaskByID(id); err == nil {
+		t.Error("GetTaskByID() after Stop error = nil, want the repository closed")
+	}
+	if got, err := reopen(t, a).GetTaskByID(id); err != nil || got.Status != repository.StatusCompleted || got.Result != "5" {
+		t.Errorf("expression = %+v, %v, want it completed with 5", got, err)
+	}
+	if _, err := http.Get("http://" + a.config.ServerAddress + "/api/v1/expressions"); err == nil {
+		t.Error("HTTP request after Stop error = nil, want the server closed")
+	}
+}
+
+func TestStopReleasesLeases(t *testing.T) {
+	a := startTestApp(t)
+	id, err := a.service.Submit(testUserID, "2+3", calculator.ModeFloat)
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+
+	s := connectAgent(t, agentClient(t, a), "agent-1", 1)
+	s.ready(t, 1)
+	task := s.task(t)
+
+	// The agent never reports, so its stream is closed when the shutdown
+	// timeout runs out and the task goes back to the queue.
+	waitStopped(t, stopApp(a, 300*time.Millisecond))
+
+	repo := reopen(t, a)
+	got, err := repo.GetTaskByID(task.Id)
+	if err != nil {
+		t.Fatalf("GetTaskByID() error = %v", err)
+	}
+	if got.Status != repository.StatusPending || got.Attempts != 0 {
+		t.Errorf("operation = %s after %d attempts, want %s after 0", got.Status, got.Attempts, repository.StatusPending)
+	}
+	if expr, err := repo.GetTaskByID(id); err != nil || expr.Status != repository.StatusPending {
+		t.Errorf("expression = %+v, %v, want it pending", expr, err)
+	}
+}
+
+func TestStopWaitsForTasksOfTheStream(t *testing.T) {
+	a := startTestApp(t)
+	for _, expr := range []string{"2+3", "4+5"} {
+		if _, err := a.service.Submit(testUserID, expr, calculator.ModeFloat); err != nil {
+			t.Fatalf("Submit(%q) error = %v", expr, err)
+		}
+	}
+
+	// The first stream of the agent is lost while it holds a task.
+	client := agentClient(t, a)
+	lost := connectAgent(t, client, "agent-1", 1)
+	lost.ready(t, 1)
+	first := lost.task(t)
+	lost.cancel()
+	time.Sleep(200 * time.Millisecond)
+
+	s := connectAgent(t, client, "agent-1", 1)
+	s.ready(t, 1)
+	second := s.task(t)
+	done := stopApp(a, 10*time.Second)
+
+	// The result of the task of the lost stream does not count for the
+	// task sent on this one.
+	s.result(t, first.Id, "5")
+	stillRunning(t, done, "the agent reported the task of its stream")
+	s.result(t, second.Id, "9")
+	waitStopped(t, done)
+}
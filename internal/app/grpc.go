@@ -0,0 +1,354 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/zubrodin/calc-service/internal/grpc"
+	"github.com/zubrodin/calc-service/internal/repository"
+	"github.com/zubrodin/calc-service/internal/service"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type calculatorServer struct {
+	pb.UnimplementedCalculatorServer
+	service        *service.Service
+	repo           repository.Repository
+	leaseTimeout   time.Duration
+	operationTimes map[string]time.Duration
+	functionTime   time.Duration
+	// shutdown is closed when the orchestrator stops; streams then stop
+	// dispatching and end once their tasks have been reported.
+	shutdown <-chan struct{}
+	sessions *sessions
+}
+
+// dispatchPollInterval bounds how long Connect waits for a notification
+// before looking for ready tasks again.
+const dispatchPollInterval = 5 * time.Second
+
+// retryDelay is suggested to agents when the database is temporarily busy.
+const retryDelay = time.Second
+
+func (s *calculatorServer) GetTask(ctx context.Context, req *pb.TaskRequest) (*pb.TaskResponse, error) {
+	// Agents using the unary API are registered on every request, which
+	// doubles as their heartbeat.
+	id, err := s.unaryWorkerID(ctx, req.WorkerId)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		if err := s.repo.RegisterWorker(repository.Worker{
+			ID:       id,
+			Capacity: int(req.Capacity),
+		}); err != nil {
+			log.Printf("Failed to register agent %s: %v", id, err)
+		}
+	}
+
+	task, err := s.repo.GetPendingTask(id, s.leaseTimeout)
+	if err != nil {
+		return nil, statusError(err, "get task")
+	}
+	if task == nil {
+		return &pb.TaskResponse{}, nil
+	}
+
+	return s.taskResponse(task), nil
+}
+
+// Connect pushes ready tasks to an agent and receives their results on the
+// same stream. The agent opens with a hello, then grants slots with ready
+// messages; a task is only sent into a free slot. A drain request stops
+// dispatching and is acknowledged once no more tasks will be sent. When the
+// orchestrator shuts down, the stream ends with Unavailable as soon as the
+// agent has reported every task sent on it.
+func (s *calculatorServer) Connect(stream pb.Calculator_ConnectServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := first.GetHello()
+	if hello == nil {
+		return invalidArgument("stream must start with a hello")
+	}
+	if hello.WorkerId, err = workerID(stream.Context(), hello.WorkerId); err != nil {
+		return err
+	}
+	var violations []*errdetails.BadRequest_FieldViolation
+	if hello.WorkerId == "" {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "hello.worker_id",
+			Description: "must not be empty",
+		})
+	}
+	if hello.Capacity < 1 {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "hello.capacity",
+			Description: "must be at least 1",
+		})
+	}
+	if len(violations) > 0 {
+		return invalidArgument("invalid hello", violations...)
+	}
+	if err := s.sessions.open(stream.Context(), hello.WorkerId); err != nil {
+		return err
+	}
+	defer s.sessions.close(hello.WorkerId)
+	worker := repository.Worker{
+		ID:       hello.WorkerId,
+		Hostname: hello.Hostname,
+		Capacity: int(hello.Capacity),
+	}
+	if err := s.repo.RegisterWorker(worker); err != nil {
+		return statusError(err, "register worker")
+	}
+	log.Printf("Agent %s (%s) connected with capacity %d", worker.ID, worker.Hostname, worker.Capacity)
+	defer log.Printf("Agent %s disconnected", worker.ID)
+
+	slots := make(chan int32)
+	// reported receives the IDs of tasks the agent has reported.
+	reported := make(chan string)
+	drainRequested := make(chan struct{})
+	recvErr := make(chan error, 1)
+	go func() {
+		var drainOnce sync.Once
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			switch p := msg.Payload.(type) {
+			case *pb.WorkerMessage_Ready:
+				select {
+				case slots <- p.Ready:
+				case <-stream.Context().Done():
+					return
+				}
+			case *pb.WorkerMessage_Result:
+				// The stream is bound to the worker from the hello, whatever
+				// the message itself claims. Reports that cannot be saved
+				// are not sent back to the agent but dropped: the lease of
+				// the operation expires and it is handed out again. An
+				// invalid result fails the operation at once.
+				if err := s.service.SaveResult(p.Result.Id, worker.ID, resultValue(p.Result)); err != nil {
+					log.Printf("Agent %s: failed to save result of %s: %v", worker.ID, p.Result.Id, err)
+				}
+				select {
+				case reported <- p.Result.Id:
+				case <-stream.Context().Done():
+					return
+				}
+			case *pb.WorkerMessage_Error:
+				if err := s.service.SaveError(p.Error.Id, worker.ID, p.Error.Error); err != nil {
+					log.Printf("Agent %s: failed to save error of %s: %v", worker.ID, p.Error.Id, err)
+				}
+				select {
+				case reported <- p.Error.Id:
+				case <-stream.Context().Done():
+					return
+				}
+			case *pb.WorkerMessage_Drain:
+				drainOnce.Do(func() { close(drainRequested) })
+			case *pb.WorkerMessage_Heartbeat:
+				err := s.repo.TouchWorker(worker.ID)
+				if err == repository.ErrWorkerNotFound {
+					err = s.repo.RegisterWorker(worker)
+				}
+				if err != nil {
+					log.Printf("Agent %s: failed to record heartbeat: %v", worker.ID, err)
+				}
+			}
+		}
+	}()
+
+	// inFlight holds the tasks sent on this stream that the agent has not
+	// reported yet.
+	free, inFlight := 0, make(map[string]bool)
+	draining, stopping := false, false
+	drain, shutdown := drainRequested, s.shutdown
+	for {
+		if stopping && len(inFlight) == 0 {
+			return status.Error(codes.Unavailable, "orchestrator is shutting down")
+		}
+
+		ready := s.service.TasksReady()
+
+		for free > 0 && !draining && !stopping {
+			task, err := s.repo.GetPendingTask(worker.ID, s.leaseTimeout)
+			if err != nil {
+				log.Printf("Agent %s: failed to get task: %v", worker.ID, err)
+				break
+			}
+			if task == nil {
+				break
+			}
+			if err := stream.Send(&pb.ServerMessage{
+				Payload: &pb.ServerMessage_Task{Task: s.taskResponse(task)},
+			}); err != nil {
+				// The lease expires and the reaper hands the task out again.
+				return err
+			}
+			free--
+			inFlight[task.ID] = true
+		}
+
+		select {
+		case n := <-slots:
+			free = min(free+int(n), worker.Capacity)
+		case id := <-reported:
+			// Results of tasks sent on an earlier stream are reported
+			// here too, but the stream does not wait for them.
+			delete(inFlight, id)
+		case <-shutdown:
+			shutdown = nil
+			stopping = true
+		case <-drain:
+			drain = nil
+			draining = true
+			if err := stream.Send(&pb.ServerMessage{
+				Payload: &pb.ServerMessage_Drained{Drained: true},
+			}); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-ready:
+		case <-time.After(dispatchPollInterval):
+		}
+	}
+}
+
+func (s *calculatorServer) taskResponse(task *repository.Task) *pb.TaskResponse {
+	args := []string{task.Arg1}
+	if task.Arity > 1 {
+		args = append(args, task.Arg2)
+	}
+
+	operationTime, ok := s.operationTimes[task.Operation]
+	if !ok {
+		operationTime = s.functionTime
+	}
+
+	return &pb.TaskResponse{
+		Id:              task.ID,
+		Arg1:            task.Arg1,
+		Arg2:            task.Arg2,
+		Args:            args,
+		Operation:       task.Operation,
+		OperationTimeMs: operationTime.Milliseconds(),
+		Mode:            task.Mode,
+	}
+}
+
+// unaryWorkerID is workerID for the unary API, which may not act as an
+// agent connected over a stream unless the caller proves its ID.
+func (s *calculatorServer) unaryWorkerID(ctx context.Context, claimed string) (string, error) {
+	id, err := workerID(ctx, claimed)
+	if err != nil {
+		return "", err
+	}
+	if err := s.sessions.check(ctx, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// resultValue returns the result reported by an agent. Agents that predate
+// decimal mode only send it as a number.
+func resultValue(req *pb.ResultRequest) string {
+	if req.Value != "" {
+		return req.Value
+	}
+	return strconv.FormatFloat(req.Result, 'g', -1, 64)
+}
+
+func (s *calculatorServer) SubmitResult(ctx context.Context, req *pb.ResultRequest) (*pb.ResultResponse, error) {
+	if req.Id == "" {
+		return &pb.ResultResponse{Success: false}, invalidArgument("id is required")
+	}
+	id, err := s.unaryWorkerID(ctx, req.WorkerId)
+	if err != nil {
+		return &pb.ResultResponse{Success: false}, err
+	}
+	if err := s.service.SaveResult(req.Id, id, resultValue(req)); err != nil {
+		return &pb.ResultResponse{Success: false}, statusError(err, "save result of "+req.Id)
+	}
+	return &pb.ResultResponse{Success: true}, nil
+}
+
+func (s *calculatorServer) ReportError(ctx context.Context, req *pb.ErrorRequest) (*pb.ResultResponse, error) {
+	if req.Id == "" {
+		return &pb.ResultResponse{Success: false}, invalidArgument("id is required")
+	}
+	id, err := s.unaryWorkerID(ctx, req.WorkerId)
+	if err != nil {
+		return &pb.ResultResponse{Success: false}, err
+	}
+	if err := s.service.SaveError(req.Id, id, req.Error); err != nil {
+		return &pb.ResultResponse{Success: false}, statusError(err, "save error of "+req.Id)
+	}
+	return &pb.ResultResponse{Success: true}, nil
+}
+
+// statusError converts an error that occurred while trying to perform action
+// into a gRPC status with a canonical code, so that agents can tell failures
+// worth retrying from rejected requests. Transient database errors carry
+// RetryInfo with the suggested delay.
+func statusError(err error, action string) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, repository.ErrTaskNotFound), errors.Is(err, repository.ErrWorkerNotFound):
+		code = codes.NotFound
+	case errors.Is(err, repository.ErrTaskNotInProgress), errors.Is(err, repository.ErrTaskCanceled):
+		code = codes.FailedPrecondition
+	case errors.Is(err, repository.ErrTaskNotLeased):
+		code = codes.PermissionDenied
+	case errors.Is(err, service.ErrInvalidResult):
+		code = codes.InvalidArgument
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case repository.IsTransient(err):
+		st := status.Newf(codes.Unavailable, "failed to %s: %v", action, err)
+		detailed, detailsErr := st.WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(retryDelay),
+		})
+		if detailsErr != nil {
+			return st.Err()
+		}
+		return detailed.Err()
+	default:
+		code = codes.Internal
+	}
+	return status.Errorf(code, "failed to %s: %v", action, err)
+}
+
+// invalidArgument rejects a malformed request, listing the offending fields
+// if there are any.
+func invalidArgument(msg string, violations ...*errdetails.BadRequest_FieldViolation) error {
+	st := status.New(codes.InvalidArgument, msg)
+	if len(violations) == 0 {
+		return st.Err()
+	}
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,703 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	pb "github.com/zubrodin/calc-service/internal/grpc"
+	"github.com/zubrodin/calc-service/internal/repository"
+	"github.com/zubrodin/calc-service/internal/service"
+	"github.com/zubrodin/calc-service/pkg/calculator"
+	"github.com/zubrodin/calc-service/pkg/validator"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantCode  codes.Code
+		wantRetry bool
+	}{
+		{"task not found", repository.ErrTaskNotFound, codes.NotFound, false},
+		{"worker not found", repository.ErrWorkerNotFound, codes.NotFound, false},
+		{"not in progress", repository.ErrTaskNotInProgress, codes.FailedPrecondition, false},
+		{"canceled task", repository.ErrTaskCanceled, codes.FailedPrecondition, false},
+		{"leased to another worker", repository.ErrTaskNotLeased, codes.PermissionDenied, false},
+		{"wrapped", fmt.Errorf("failed to save: %w", repository.ErrTaskNotLeased), codes.PermissionDenied, false},
+		{"invalid result", service.ErrInvalidResult, codes.InvalidArgument, false},
+		{"context canceled", context.Canceled, codes.Canceled, false},
+		{"deadline exceeded", context.DeadlineExceeded, codes.DeadlineExceeded, false},
+		{"database busy", sqlite3.Error{Code: sqlite3.ErrBusy}, codes.Unavailable, true},
+		{"database locked", fmt.Errorf("failed to save: %w", sqlite3.Error{Code: sqlite3.ErrLocked}), codes.Unavailable, true},
+		{"other", errors.New("disk I/O error"), codes.Internal, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(statusError(tt.err, "save result"))
+			if st.Code() != tt.wantCode {
+				t.Errorf("code = %v, want %v", st.Code(), tt.wantCode)
+			}
+			var retry bool
+			for _, d := range st.Details() {
+				if _, ok := d.(*errdetails.RetryInfo); ok {
+					retry = true
+				}
+			}
+			if retry != tt.wantRetry {
+				t.Errorf("RetryInfo present = %v, want %v", retry, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestInvalidArgument(t *testing.T) {
+	st := status.Convert(invalidArgument("invalid result", &errdetails.BadRequest_FieldViolation{
+		Field:       "result",
+		Description: "must be a number",
+	}))
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("code = %v, want %v", st.Code(), codes.InvalidArgument)
+	}
+	if len(st.Details()) != 1 {
+		t.Fatalf("details = %v, want one BadRequest", st.Details())
+	}
+	br, ok := st.Details()[0].(*errdetails.BadRequest)
+	if !ok || len(br.FieldViolations) != 1 || br.FieldViolations[0].Field != "result" {
+		t.Errorf("details = %v, want a violation of field result", st.Details())
+	}
+}
+
+func withToken(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+}
+
+func withAgent(id string) context.Context {
+	return context.WithValue(context.Background(), agentIDContextKey, id)
+}
+
+func TestAgentAuthenticator(t *testing.T) {
+	a := newAgentAuthenticator("shared", map[string]string{"agent-1": "token-1"})
+
+	tests := []struct {
+		name     string
+		header   string
+		wantID   string
+		wantCode codes.Code
+	}{
+		{"shared token", "Bearer shared", "", codes.OK},
+		{"agent token", "Bearer token-1", "agent-1", codes.OK},
+		{"missing", "", "", codes.Unauthenticated},
+		{"other scheme", "Basic shared", "", codes.Unauthenticated},
+		{"empty token", "Bearer ", "", codes.Unauthenticated},
+		{"wrong token", "Bearer token-2", "", codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.authenticate(withToken(tt.header))
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("authenticate() code = %v, want %v", code, tt.wantCode)
+			}
+			if id != tt.wantID {
+				t.Errorf("authenticate() = %q, want %q", id, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestWorkerID(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		claimed  string
+		want     string
+		wantCode codes.Code
+	}{
+		{"shared token", context.Background(), "worker-1", "worker-1", codes.OK},
+		{"agent token", withAgent("agent-1"), "agent-1", "agent-1", codes.OK},
+		{"agent token without a claim", withAgent("agent-1"), "", "agent-1", codes.OK},
+		{"other agent", withAgent("agent-1"), "agent-2", "", codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := workerID(tt.ctx, tt.claimed)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("workerID() code = %v, want %v", code, tt.wantCode)
+			}
+			if id != tt.want {
+				t.Errorf("workerID() = %q, want %q", id, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := newSessions()
+	unverified := context.Background()
+	verified := withAgent("worker-1")
+
+	if err := s.check(unverified, "worker-1"); err != nil {
+		t.Fatalf("check() of an agent without a stream error = %v", err)
+	}
+	if err := s.open(unverified, "worker-1"); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		call     func() error
+		wantCode codes.Code
+	}{
+		{"second stream", func() error { return s.open(unverified, "worker-1") }, codes.AlreadyExists},
+		{"unary call", func() error { return s.check(unverified, "worker-1") }, codes.PermissionDenied},
+		{"unary call with agent token", func() error { return s.check(verified, "worker-1") }, codes.OK},
+		{"other agent", func() error { return s.check(unverified, "worker-2") }, codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := status.Code(tt.call()); code != tt.wantCode {
+				t.Errorf("code = %v, want %v", code, tt.wantCode)
+			}
+		})
+	}
+
+	s.close("worker-1")
+	if err := s.check(unverified, "worker-1"); err != nil {
+		t.Errorf("check() after the stream closed error = %v", err)
+	}
+	if err := s.open(unverified, "worker-1"); err != nil {
+		t.Errorf("open() after the stream closed error = %v", err)
+	}
+}
+
+func TestConnectAuthentication(t *testing.T) {
+	a := newAgentAuthenticator("", map[string]string{"agent-1": "token-1"})
+	o := newTestOrchestrator(t, time.Minute,
+		grpc.UnaryInterceptor(a.unaryInterceptor),
+		grpc.StreamInterceptor(a.streamInterceptor))
+
+	tests := []struct {
+		name     string
+		token    string
+		workerID string
+		wantCode codes.Code
+	}{
+		{"without a token", "", "agent-1", codes.Unauthenticated},
+		{"wrong token", "token-2", "agent-1", codes.Unauthenticated},
+		{"other agent", "token-1", "agent-2", codes.PermissionDenied},
+		{"own token", "token-1", "agent-1", codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.token != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tt.token)
+			}
+			stream, err := o.client.Connect(ctx)
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			if err := stream.Send(&pb.WorkerMessage{Payload: &pb.WorkerMessage_Hello{Hello: &pb.WorkerHello{
+				WorkerId: tt.workerID,
+				Capacity: 1,
+			}}}); err != nil && err != io.EOF {
+				t.Fatalf("Send() error = %v", err)
+			}
+			if tt.wantCode == codes.OK {
+				if err := stream.Send(&pb.WorkerMessage{Payload: &pb.WorkerMessage_Drain{Drain: true}}); err != nil {
+					t.Fatalf("Send() error = %v", err)
+				}
+			}
+			_, err = stream.Recv()
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("Recv() error = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+const testUserID = 1
+
+type testOrchestrator struct {
+	client  pb.CalculatorClient
+	service *service.Service
+	repo    *repository.SQLiteRepository
+}
+
+// newTestOrchestrator serves the calculator over an in-memory connection.
+func newTestOrchestrator(t *testing.T, leaseTimeout time.Duration, opts ...grpc.ServerOption) *testOrchestrator {
+	t.Helper()
+	repo, err := repository.NewSQLiteRepository(filepath.Join(t.TempDir(), "calc.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	calc := calculator.New()
+	svc := service.New(calc, validator.New(calc), repo)
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(opts...)
+	pb.RegisterCalculatorServer(srv, &calculatorServer{
+		service:      svc,
+		repo:         repo,
+		leaseTimeout: leaseTimeout,
+		sessions:     newSessions(),
+	})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testOrchestrator{client: pb.NewCalculatorClient(conn), service: svc, repo: repo}
+}
+
+func (o *testOrchestrator) submit(t *testing.T, expr string) string {
+	t.Helper()
+	return o.submitMode(t, expr, calculator.ModeFloat)
+}
+
+func (o *testOrchestrator) submitMode(t *testing.T, expr string, mode calculator.Mode) string {
+	t.Helper()
+	id, err := o.service.Submit(testUserID, expr, mode)
+	if err != nil {
+		t.Fatalf("Submit(%q) error = %v", expr, err)
+	}
+	return id
+}
+
+// testStream is the agent side of a Connect stream. Messages are received
+// in the background so that a test can also check that nothing arrives.
+type testStream struct {
+	stream   pb.Calculator_ConnectClient
+	cancel   context.CancelFunc
+	messages chan *pb.ServerMessage
+	err      chan error
+}
+
+func (o *testOrchestrator) connect(t *testing.T, workerID string, capacity int32) *testStream {
+	t.Helper()
+	return connectAgent(t, o.client, workerID, capacity)
+}
+
+// connectAgent opens a Connect stream and introduces the agent.
+func connectAgent(t *testing.T, client pb.CalculatorClient, workerID string, capacity int32) *testStream {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := client.Connect(ctx)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	s := &testStream{
+		stream:   stream,
+		cancel:   cancel,
+		messages: make(chan *pb.ServerMessage, 16),
+		err:      make(chan error, 1),
+	}
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				s.err <- err
+				return
+			}
+			s.messages <- msg
+		}
+	}()
+
+	s.send(t, &pb.WorkerMessage{Payload: &pb.WorkerMessage_Hello{Hello: &pb.WorkerHello{
+		WorkerId: workerID,
+		Capacity: capacity,
+	}}})
+	return s
+}
+
+func (s *testStream) send(t *testing.T, msg *pb.WorkerMessage) {
+	t.Helper()
+	if err := s.stream.Send(msg); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+}
+
+func (s *testStream) ready(t *testing.T, n int32) {
+	t.Helper()
+	s.send(t, &pb.WorkerMessage{Payload: &pb.WorkerMessage_Ready{Ready: n}})
+}
+
+func (s *testStream) result(t *testing.T, id, value string) {
+	t.Helper()
+	s.send(t, &pb.WorkerMessage{Payload: &pb.WorkerMessage_Result{Result: &pb.ResultRequest{Id: id, Value: value}}})
+}
+
+func (s *testStream) next(t *testing.T) *pb.ServerMessage {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		return msg
+	case err := <-s.err:
+		t.Fatalf("Recv() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message from the orchestrator")
+	}
+	return nil
+}
+
+func (s *testStream) task(t *testing.T) *pb.TaskResponse {
+	t.Helper()
+	msg := s.next(t)
+	if msg.GetTask() == nil {
+		t.Fatalf("message = %v, want a task", msg)
+	}
+	return msg.GetTask()
+}
+
+// idle checks that the orchestrator sends nothing for a while.
+func (s *testStream) idle(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		t.Fatalf("message = %v, want none", msg)
+	case err := <-s.err:
+		t.Fatalf("Recv() error = %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func waitStatus(t *testing.T, repo *repository.SQLiteRepository, id, status string) *repository.Task {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		task, err := repo.GetTaskByID(id)
+		if err != nil {
+			t.Fatalf("GetTaskByID(%q) error = %v", id, err)
+		}
+		if task.Status == status {
+			return task
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status of %s = %q, want %q", id, task.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectRequiresHello(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	stream, err := o.client.Connect(context.Background())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	if err := stream.Send(&pb.WorkerMessage{Payload: &pb.WorkerMessage_Ready{Ready: 1}}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Recv() error = %v, want code %v for a stream without hello", err, codes.InvalidArgument)
+	}
+}
+
+func TestConnectInvalidHello(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	stream, err := o.client.Connect(context.Background())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	if err := stream.Send(&pb.WorkerMessage{Payload: &pb.WorkerMessage_Hello{Hello: &pb.WorkerHello{}}}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	_, err = stream.Recv()
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument || len(st.Details()) != 1 {
+		t.Fatalf("Recv() error = %v, want %v with details", err, codes.InvalidArgument)
+	}
+	br, ok := st.Details()[0].(*errdetails.BadRequest)
+	if !ok || len(br.FieldViolations) != 2 {
+		t.Errorf("details = %v, want violations of worker_id and capacity", st.Details())
+	}
+}
+
+func TestConnectRegistersWorker(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	s := o.connect(t, "agent-1", 2)
+	s.send(t, &pb.WorkerMessage{Payload: &pb.WorkerMessage_Heartbeat{Heartbeat: true}})
+	s.idle(t)
+
+	workers, err := o.repo.GetWorkers()
+	if err != nil {
+		t.Fatalf("GetWorkers() error = %v", err)
+	}
+	if len(workers) != 1 || workers[0].ID != "agent-1" || workers[0].Capacity != 2 {
+		t.Errorf("GetWorkers() = %+v, want agent-1 with capacity 2", workers)
+	}
+}
+
+func TestConnectFillsFreeSlots(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	for _, expr := range []string{"1+2", "3*4", "5-1"} {
+		o.submit(t, expr)
+	}
+
+	s := o.connect(t, "agent-1", 2)
+	// Slots granted beyond the capacity are ignored.
+	s.ready(t, 5)
+	first := s.task(t)
+	s.task(t)
+	s.idle(t)
+
+	s.result(t, first.Id, "0")
+	s.ready(t, 1)
+	s.task(t)
+	s.idle(t)
+}
+
+func TestConnectPushesNewTasks(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	s := o.connect(t, "agent-1", 1)
+	s.ready(t, 1)
+	s.idle(t)
+
+	o.submit(t, "2*3")
+	if task := s.task(t); task.Operation != "*" || task.Arg1 != "2" || task.Arg2 != "3" {
+		t.Errorf("task = %v, want 2 * 3", task)
+	}
+}
+
+func TestConnectSendsFunctionArguments(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	o.submit(t, "sqrt(16)")
+	s := o.connect(t, "agent-1", 1)
+	s.ready(t, 1)
+	if task := s.task(t); task.Operation != "sqrt" || len(task.Args) != 1 || task.Args[0] != "16" {
+		t.Errorf("task = %v, want sqrt of 16", task)
+	}
+}
+
+func TestConnectSavesResults(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	id := o.submit(t, "(1+2)*4")
+	s := o.connect(t, "agent-1", 1)
+	s.ready(t, 1)
+
+	sum := s.task(t)
+	s.result(t, sum.Id, "3")
+	s.ready(t, 1)
+	// The product only becomes ready once the sum is saved.
+	product := s.task(t)
+	if product.Operation != "*" || product.Arg1 != "3" {
+		t.Fatalf("task = %v, want 3 * 4", product)
+	}
+	s.result(t, product.Id, "12")
+	if task := waitStatus(t, o.repo, id, repository.StatusCompleted); task.Result != "12" {
+		t.Errorf("result = %q, want 12", task.Result)
+	}
+
+	other := o.submit(t, "1/0")
+	s.ready(t, 1)
+	division := s.task(t)
+	s.send(t, &pb.WorkerMessage{Payload: &pb.WorkerMessage_Error{Error: &pb.ErrorRequest{
+		Id:    division.Id,
+		Error: "division by zero",
+	}}})
+	if task := waitStatus(t, o.repo, other, repository.StatusFailed); task.Error != "division by zero" {
+		t.Errorf("error = %q, want %q", task.Error, "division by zero")
+	}
+}
+
+func TestConnectDecimalMode(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	id := o.submitMode(t, "1/3", calculator.ModeDecimal)
+	s := o.connect(t, "agent-1", 1)
+	s.ready(t, 1)
+
+	task := s.task(t)
+	if task.Mode != string(calculator.ModeDecimal) {
+		t.Fatalf("task mode = %q, want %q", task.Mode, calculator.ModeDecimal)
+	}
+	s.result(t, task.Id, "1/3")
+	if got := waitStatus(t, o.repo, id, repository.StatusCompleted); got.Result != "1/3" {
+		t.Errorf("result = %q, want 1/3", got.Result)
+	}
+}
+
+func TestConnectResultWithoutValue(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	id := o.submit(t, "1+1.5")
+	s := o.connect(t, "agent-1", 1)
+	s.ready(t, 1)
+
+	// Agents that predate decimal mode only report the number.
+	task := s.task(t)
+	s.send(t, &pb.WorkerMessage{Payload: &pb.WorkerMessage_Result{Result: &pb.ResultRequest{Id: task.Id, Result: 2.5}}})
+	if got := waitStatus(t, o.repo, id, repository.StatusCompleted); got.Result != "2.5" {
+		t.Errorf("result = %q, want 2.5", got.Result)
+	}
+}
+
+func TestConnectInvalidResult(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	for i, value := range []string{"abc", "NaN", "+Inf"} {
+		id := o.submit(t, "2+3*4")
+		s := o.connect(t, fmt.Sprintf("agent-%d", i), 1)
+		s.ready(t, 1)
+
+		// The expression fails at once instead of waiting for the lease to
+		// expire, and the invalid value is passed on to nothing.
+		task := s.task(t)
+		s.result(t, task.Id, value)
+		if got := waitStatus(t, o.repo, id, repository.StatusFailed); got.Error != "agent reported an invalid result" {
+			t.Errorf("%s: error = %q, want an invalid result", value, got.Error)
+		}
+		if got, err := o.repo.GetTaskByID(task.Id); err != nil || got.Result != "" {
+			t.Errorf("%s: operation = %+v, %v, want no result", value, got, err)
+		}
+	}
+}
+
+func TestSubmitInvalidResult(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	id := o.submit(t, "2+3")
+	task, err := o.repo.GetPendingTask("agent-1", time.Minute)
+	if err != nil || task == nil {
+		t.Fatalf("GetPendingTask() = %v, %v, want an operation", task, err)
+	}
+
+	_, err = o.client.SubmitResult(context.Background(), &pb.ResultRequest{Id: task.ID, Value: "1e400", WorkerId: "agent-1"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("SubmitResult() error = %v, want code %v", err, codes.InvalidArgument)
+	}
+	if got, err := o.repo.GetTaskByID(id); err != nil || got.Status != repository.StatusFailed {
+		t.Errorf("expression = %+v, %v, want it failed", got, err)
+	}
+}
+
+func TestConnectBindsResultsToWorker(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	id := o.submit(t, "2+3")
+	owner := o.connect(t, "agent-1", 1)
+	owner.ready(t, 1)
+	task := owner.task(t)
+
+	// A result for a task leased to another agent is refused, whatever
+	// worker the message claims.
+	other := o.connect(t, "agent-2", 1)
+	other.send(t, &pb.WorkerMessage{Payload: &pb.WorkerMessage_Result{Result: &pb.ResultRequest{
+		Id:       task.Id,
+		Value:    "6",
+		WorkerId: "agent-1",
+	}}})
+	other.idle(t)
+	if got, err := o.repo.GetTaskByID(id); err != nil || got.Status != repository.StatusPending {
+		t.Fatalf("expression = %+v, %v, want it pending", got, err)
+	}
+
+	owner.result(t, task.Id, "5")
+	if got := waitStatus(t, o.repo, id, repository.StatusCompleted); got.Result != "5" {
+		t.Errorf("result = %q, want 5", got.Result)
+	}
+}
+
+func TestConnectDrain(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	s := o.connect(t, "agent-1", 1)
+	s.send(t, &pb.WorkerMessage{Payload: &pb.WorkerMessage_Drain{Drain: true}})
+	if msg := s.next(t); !msg.GetDrained() {
+		t.Fatalf("message = %v, want the drain acknowledgement", msg)
+	}
+
+	// No tasks are sent after the acknowledgement, even into free slots.
+	o.submit(t, "1+1")
+	s.ready(t, 1)
+	s.idle(t)
+
+	if err := s.stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend() error = %v", err)
+	}
+	select {
+	case err := <-s.err:
+		if err != io.EOF {
+			t.Errorf("Recv() error = %v, want %v", err, io.EOF)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed")
+	}
+}
+
+func TestConnectBindsWorkerToStream(t *testing.T) {
+	o := newTestOrchestrator(t, time.Minute)
+	o.submit(t, "2+3")
+	s := o.connect(t, "agent-1", 1)
+	s.ready(t, 1)
+	task := s.task(t)
+
+	// While the stream is open, nobody else may act as agent-1.
+	other := o.connect(t, "agent-1", 1)
+	select {
+	case err := <-other.err:
+		if status.Code(err) != codes.AlreadyExists {
+			t.Errorf("second stream error = %v, want code %v", err, codes.AlreadyExists)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second stream was not refused")
+	}
+	_, err := o.client.SubmitResult(context.Background(), &pb.ResultRequest{Id: task.Id, Value: "6", WorkerId: "agent-1"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("SubmitResult() error = %v, want code %v", err, codes.PermissionDenied)
+	}
+}
+
+func TestConnectReconnect(t *testing.T) {
+	// Leases expire right away; expiry is stored with a precision of a second.
+	o := newTestOrchestrator(t, 0)
+	id := o.submit(t, "1+2")
+
+	lost := o.connect(t, "agent-1", 1)
+	lost.ready(t, 1)
+	task := lost.task(t)
+	lost.cancel()
+
+	// The lease of the task held by the lost stream expires and the task is
+	// handed out again when the agent comes back.
+	time.Sleep(1100 * time.Millisecond)
+	if released, _, err := o.repo.ReleaseExpiredLeases(3); err != nil || released != 1 {
+		t.Fatalf("ReleaseExpiredLeases() = %d, %v, want 1 released", released, err)
+	}
+
+	s := o.connect(t, "agent-1", 1)
+	s.ready(t, 1)
+	if again := s.task(t); again.Id != task.Id {
+		t.Fatalf("task = %v, want %s again", again, task.Id)
+	}
+	s.result(t, task.Id, "3")
+	if got := waitStatus(t, o.repo, id, repository.StatusCompleted); got.Result != "3" {
+		t.Errorf("result = %q, want 3", got.Result)
+	}
+}
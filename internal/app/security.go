@@ -0,0 +1,195 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/zubrodin/calc-service/internal/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type contextKey int
+
+const agentIDContextKey contextKey = iota
+
+// grpcCredentials loads the server certificate for the agent channel and,
+// if a client CA is configured, requires agents to present a certificate
+// signed by it.
+func grpcCredentials(cfg *config.Config) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.GRPCTLSCertFile, cfg.GRPCTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.GRPCClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.GRPCClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.GRPCClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// agentAuthenticator checks the token agents send as "authorization:
+// Bearer <token>" metadata with every call.
+type agentAuthenticator struct {
+	sharedToken string
+	// agents maps per-agent tokens to the ID of the agent owning them.
+	agents map[string]string
+}
+
+func newAgentAuthenticator(sharedToken string, agentTokens map[string]string) *agentAuthenticator {
+	agents := make(map[string]string, len(agentTokens))
+	for id, token := range agentTokens {
+		agents[token] = id
+	}
+	return &agentAuthenticator{sharedToken: sharedToken, agents: agents}
+}
+
+func (a *agentAuthenticator) enabled() bool {
+	return a.sharedToken != "" || len(a.agents) > 0
+}
+
+// authenticate returns the ID of the agent owning the token of the call, or
+// an empty ID for the shared token.
+func (a *agentAuthenticator) authenticate(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", status.Error(codes.Unauthenticated, "agent token is required")
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok || token == "" {
+		return "", status.Error(codes.Unauthenticated, "authorization must use the Bearer scheme")
+	}
+
+	if a.sharedToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.sharedToken)) == 1 {
+		return "", nil
+	}
+	for t, id := range a.agents {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return id, nil
+		}
+	}
+	return "", status.Error(codes.Unauthenticated, "invalid agent token")
+}
+
+func (a *agentAuthenticator) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	id, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, agentIDContextKey, id), req)
+}
+
+func (a *agentAuthenticator) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id, err := a.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{
+		ServerStream: ss,
+		ctx:          context.WithValue(ss.Context(), agentIDContextKey, id),
+	})
+}
+
+// authenticatedStream carries the authenticated agent in its context.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticatedAgent returns the ID of the agent proven by its own token,
+// or an empty ID for calls with the shared token or without authentication.
+func authenticatedAgent(ctx context.Context) string {
+	id, _ := ctx.Value(agentIDContextKey).(string)
+	return id
+}
+
+// workerID returns the worker a call acts as. Agents authenticated with
+// their own token may only act as themselves; otherwise the worker ID
+// claimed in the request is taken, and sessions bind it to the stream that
+// claimed it first.
+func workerID(ctx context.Context, claimed string) (string, error) {
+	id := authenticatedAgent(ctx)
+	if id == "" {
+		return claimed, nil
+	}
+	if claimed != "" && claimed != id {
+		return "", status.Errorf(codes.PermissionDenied, "token of agent %s cannot be used by %s", id, claimed)
+	}
+	return id, nil
+}
+
+// sessions tracks the agents connected over Connect streams. Without a
+// per-agent token nothing proves the ID an agent claims, so the ID is bound
+// to the stream of the agent: another stream or a unary call claiming it
+// with the shared token, or without a token, is refused while the stream is
+// open. This prevents hijacking a connected agent, but an agent that is not
+// connected can still be impersonated; only per-agent tokens (AGENT_TOKENS)
+// make lease ownership checks reliable.
+type sessions struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newSessions() *sessions {
+	return &sessions{active: make(map[string]int)}
+}
+
+// open registers a stream of the agent id. It fails if the agent already
+// has a stream and the caller has not proven its ID.
+func (s *sessions) open(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[id] > 0 && authenticatedAgent(ctx) == "" {
+		return status.Errorf(codes.AlreadyExists, "agent %s is already connected", id)
+	}
+	s.active[id]++
+	return nil
+}
+
+func (s *sessions) close(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[id]--; s.active[id] <= 0 {
+		delete(s.active, id)
+	}
+}
+
+// check refuses a unary call acting as a connected agent unless the caller
+// has proven its ID.
+func (s *sessions) check(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[id] > 0 && authenticatedAgent(ctx) == "" {
+		return status.Errorf(codes.PermissionDenied, "agent %s is connected over a stream and only reports there", id)
+	}
+	return nil
+}
@@ -1,31 +1,172 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/zubrodin/calc-service/internal/config"
 )
 
-func GenerateToken(login string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"login": login,
-		"exp":   time.Now().Add(time.Hour * 24).Unix(),
-	})
-	return token.SignedString([]byte("secret"))
+var (
+	ErrInvalidToken   = errors.New("invalid token")
+	ErrTokenExpired   = errors.New("token expired")
+	ErrTokenMalformed = errors.New("malformed token")
+)
+
+// signingMethod is the only algorithm tokens are issued and accepted with.
+var signingMethod = jwt.SigningMethodHS256
+
+type Claims struct {
+	Login string `json:"login"`
+	jwt.RegisteredClaims
+}
+
+type Auth struct {
+	keys        map[string][]byte
+	activeKeyID string
+	ttl         time.Duration
+	refreshTTL  time.Duration
+	issuer      string
+	audience    string
+}
+
+func New(cfg *config.Config) (*Auth, error) {
+	if _, ok := cfg.JWTKeys[cfg.JWTActiveKeyID]; !ok {
+		return nil, fmt.Errorf("active JWT key %q is not configured", cfg.JWTActiveKeyID)
+	}
+
+	keys := make(map[string][]byte, len(cfg.JWTKeys))
+	for kid, secret := range cfg.JWTKeys {
+		keys[kid] = []byte(secret)
+	}
+
+	return &Auth{
+		keys:        keys,
+		activeKeyID: cfg.JWTActiveKeyID,
+		ttl:         cfg.JWTTTL,
+		refreshTTL:  cfg.RefreshTTL,
+		issuer:      cfg.JWTIssuer,
+		audience:    cfg.JWTAudience,
+	}, nil
 }
 
-func ValidateToken(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte("secret"), nil
-	})
+// TTL returns the lifetime of access tokens.
+func (a *Auth) TTL() time.Duration {
+	return a.ttl
+}
+
+func (a *Auth) GenerateToken(login string) (string, error) {
+	id, err := randomString()
 	if err != nil {
 		return "", err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims["login"].(string), nil
+	now := time.Now()
+	claims := Claims{
+		Login: login,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Subject:   login,
+			Issuer:    a.issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(a.ttl)),
+		},
+	}
+	if a.audience != "" {
+		claims.Audience = jwt.ClaimStrings{a.audience}
+	}
+
+	token := jwt.NewWithClaims(signingMethod, claims)
+	token.Header["kid"] = a.activeKeyID
+	return token.SignedString(a.keys[a.activeKeyID])
+}
+
+// ValidateToken checks the signature and the claims of an access token.
+// Revocation is not checked here: revoked token IDs live in the repository.
+func (a *Auth) ValidateToken(tokenString string) (*Claims, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{signingMethod.Alg()}),
+		jwt.WithIssuedAt(),
+	}
+	if a.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		opts = append(opts, jwt.WithAudience(a.audience))
+	}
+
+	var claims Claims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, a.key, opts...)
+	if err != nil {
+		switch {
+		case errors.Is(err, jwt.ErrTokenExpired):
+			return nil, fmt.Errorf("%w: %v", ErrTokenExpired, err)
+		case errors.Is(err, jwt.ErrTokenMalformed):
+			return nil, fmt.Errorf("%w: %v", ErrTokenMalformed, err)
+		default:
+			return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+	}
+
+	if !token.Valid || claims.Login == "" {
+		return nil, ErrInvalidToken
+	}
+	// The parser only checks "exp" when it is present, and without "jti"
+	// the token could not be revoked.
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: %v: exp", ErrInvalidToken, jwt.ErrTokenRequiredClaimMissing)
+	}
+	if claims.ID == "" {
+		return nil, fmt.Errorf("%w: %v: jti", ErrInvalidToken, jwt.ErrTokenRequiredClaimMissing)
 	}
 
-	return "", errors.New("invalid token")
+	return &claims, nil
+}
+
+// GenerateRefreshToken returns a new opaque refresh token, the hash it is
+// stored under and its expiry time. Only the hash is persisted, so a leaked
+// database does not expose usable tokens.
+func (a *Auth) GenerateRefreshToken() (token, hash string, expiresAt time.Time, err error) {
+	token, err = randomString()
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return token, HashRefreshToken(token), time.Now().Add(a.refreshTTL), nil
+}
+
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// key picks the secret by the token "kid" header. Tokens without a key ID
+// were issued before key rotation and are checked with the active key.
+func (a *Auth) key(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"]
+	if !ok {
+		return a.keys[a.activeKeyID], nil
+	}
+
+	id, ok := kid.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: kid", ErrInvalidToken)
+	}
+	key, ok := a.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidToken, id)
+	}
+	return key, nil
 }
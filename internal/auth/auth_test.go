@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zubrodin/calc-service/internal/config"
+)
+
+func newTestAuth(t *testing.T, activeKeyID string) *Auth {
+	t.Helper()
+	a, err := New(&config.Config{
+		JWTKeys:        map[string]string{"old": "old-secret", "new": "new-secret"},
+		JWTActiveKeyID: activeKeyID,
+		JWTTTL:         time.Minute,
+		RefreshTTL:     time.Hour,
+		JWTIssuer:      "calc-service",
+		JWTAudience:    "calc-users",
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return a
+}
+
+// sign makes a token the way a client or an older version of the service
+// could have: kid is omitted when empty.
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString() error = %v", err)
+	}
+	return s
+}
+
+func testClaims(modify func(c *Claims)) *Claims {
+	now := time.Now()
+	c := &Claims{
+		Login: "user1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "token-id",
+			Subject:   "user1",
+			Issuer:    "calc-service",
+			Audience:  jwt.ClaimStrings{"calc-users"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+	if modify != nil {
+		modify(c)
+	}
+	return c
+}
+
+func TestNewUnknownActiveKey(t *testing.T) {
+	_, err := New(&config.Config{
+		JWTKeys:        map[string]string{"old": "old-secret"},
+		JWTActiveKeyID: "new",
+	})
+	if err == nil {
+		t.Error("New() error = nil, want an error for an active key that is not configured")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldAuth := newTestAuth(t, "old")
+	newAuth := newTestAuth(t, "new")
+
+	token, err := oldAuth.GenerateToken("user1")
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	claims, err := newAuth.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken() of a token signed with the previous key error = %v", err)
+	}
+	if claims.Login != "user1" || claims.ID == "" {
+		t.Errorf("ValidateToken() = %+v, want login user1 with an ID", claims)
+	}
+
+	retired, err := New(&config.Config{
+		JWTKeys:        map[string]string{"new": "new-secret"},
+		JWTActiveKeyID: "new",
+		JWTIssuer:      "calc-service",
+		JWTAudience:    "calc-users",
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := retired.ValidateToken(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ValidateToken() with a retired key error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	a := newTestAuth(t, "new")
+	newKey := []byte("new-secret")
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{
+			name:  "valid",
+			token: sign(t, jwt.SigningMethodHS256, "new", newKey, testClaims(nil)),
+		},
+		{
+			name:  "signed with a previous key",
+			token: sign(t, jwt.SigningMethodHS256, "old", []byte("old-secret"), testClaims(nil)),
+		},
+		{
+			name:  "without kid",
+			token: sign(t, jwt.SigningMethodHS256, "", newKey, testClaims(nil)),
+		},
+		{
+			name:    "without ID",
+			token:   sign(t, jwt.SigningMethodHS256, "new", newKey, testClaims(func(c *Claims) { c.ID = "" })),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "unknown kid",
+			token:   sign(t, jwt.SigningMethodHS256, "other", newKey, testClaims(nil)),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "wrong key for kid",
+			token:   sign(t, jwt.SigningMethodHS256, "old", newKey, testClaims(nil)),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "other HMAC algorithm",
+			token:   sign(t, jwt.SigningMethodHS384, "new", newKey, testClaims(nil)),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "algorithm none",
+			token:   sign(t, jwt.SigningMethodNone, "new", jwt.UnsafeAllowNoneSignatureType, testClaims(nil)),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "expired",
+			token: sign(t, jwt.SigningMethodHS256, "new", newKey, testClaims(func(c *Claims) {
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			})),
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name: "without exp",
+			token: sign(t, jwt.SigningMethodHS256, "new", newKey, testClaims(func(c *Claims) {
+				c.ExpiresAt = nil
+			})),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "issued in the future",
+			token: sign(t, jwt.SigningMethodHS256, "new", newKey, testClaims(func(c *Claims) {
+				c.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+			})),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "other issuer",
+			token: sign(t, jwt.SigningMethodHS256, "new", newKey, testClaims(func(c *Claims) {
+				c.Issuer = "other"
+			})),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "other audience",
+			token: sign(t, jwt.SigningMethodHS256, "new", newKey, testClaims(func(c *Claims) {
+				c.Audience = jwt.ClaimStrings{"other"}
+			})),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "without login",
+			token: sign(t, jwt.SigningMethodHS256, "new", newKey, testClaims(func(c *Claims) {
+				c.Login = ""
+			})),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "malformed",
+			token:   "not-a-token",
+			wantErr: ErrTokenMalformed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := a.ValidateToken(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ValidateToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && claims.Login != "user1" {
+				t.Errorf("ValidateToken() login = %q, want %q", claims.Login, "user1")
+			}
+		})
+	}
+}
+
+func TestGenerateRefreshToken(t *testing.T) {
+	a := newTestAuth(t, "new")
+
+	token, hash, expiresAt, err := a.GenerateRefreshToken()
+	if err != nil {
+		t.Fatalf("GenerateRefreshToken() error = %v", err)
+	}
+	if hash != HashRefreshToken(token) || hash == token {
+		t.Errorf("GenerateRefreshToken() hash = %q, want the hash of the token", hash)
+	}
+	if d := time.Until(expiresAt); d <= 0 || d > time.Hour {
+		t.Errorf("GenerateRefreshToken() expires in %v, want within %v", d, time.Hour)
+	}
+
+	other, _, _, err := a.GenerateRefreshToken()
+	if err != nil {
+		t.Fatalf("GenerateRefreshToken() error = %v", err)
+	}
+	if other == token {
+		t.Error("GenerateRefreshToken() returned the same token twice")
+	}
+}
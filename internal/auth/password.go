@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordCost is the bcrypt cost for new hashes. Hashes made with a lower
+// cost are upgraded on the next successful login.
+const PasswordCost = bcrypt.DefaultCost
+
+// dummyHash is compared against when the user does not exist, so that
+// a login attempt takes the same time whether the login is known or not.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("calc-service"), PasswordCost)
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// VerifyPassword checks password against the stored value in constant time.
+// Values that are not bcrypt hashes were stored in plain text by older
+// versions; rehash reports that the stored value should be replaced with
+// a fresh hash.
+func VerifyPassword(stored, password string) (ok, rehash bool) {
+	if !isBcryptHash(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)); err != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err == nil && cost < PasswordCost
+}
+
+// SimulatePasswordCheck spends as much time as VerifyPassword does for
+// a real user.
+func SimulatePasswordCheck(password string) {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+func isBcryptHash(s string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
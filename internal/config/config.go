@@ -1,11 +1,100 @@
 package config
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	ServerAddress string
 	GrpcAddress   string
 	DatabasePath  string
+
+	// JWTKeys maps key IDs (the "kid" token header) to HMAC secrets.
+	// Tokens are signed with JWTActiveKeyID; the other keys are only
+	// accepted for validation, which allows rotating secrets.
+	JWTKeys        map[string]string
+	JWTActiveKeyID string
+	JWTTTL         time.Duration
+	RefreshTTL     time.Duration
+	JWTIssuer      string
+	JWTAudience    string
+
+	// TaskLeaseTimeout is how long an agent may work on an operation before
+	// it is handed out again; after TaskMaxAttempts leases it fails.
+	TaskLeaseTimeout    time.Duration
+	TaskMaxAttempts     int
+	LeaseReaperInterval time.Duration
+
+	// TLS for the agent gRPC channel. With GRPCClientCAFile set, agents
+	// must also present a certificate signed by that CA (mTLS).
+	GRPCTLSCertFile  string
+	GRPCTLSKeyFile   string
+	GRPCClientCAFile string
+
+	// AgentToken is a secret shared by all agents, AgentTokens maps agent
+	// IDs to their own tokens. Without either, agents are not authenticated.
+	// Only AgentTokens prove which agent a call comes from, which checking
+	// the ownership of leases relies on.
+	AgentToken  string
+	AgentTokens map[string]string
+
+	// ShutdownTimeout bounds how long the orchestrator waits for requests
+	// and agents to finish when it stops.
+	ShutdownTimeout time.Duration
+
+	// WorkerTimeout is how long an agent may stay silent before it is
+	// reported as dead.
+	WorkerTimeout time.Duration
+
+	// AdminLogins are the users allowed to see operator endpoints such as
+	// the list of agents.
+	AdminLogins []string
+
+	// OperationTimes is how long agents spend on each operator, which
+	// simulates expensive computations; FunctionTime applies to calls of
+	// built-in functions.
+	OperationTimes map[string]time.Duration
+	FunctionTime   time.Duration
+
+	// ImplicitMultiplication lets expressions omit * before parentheses,
+	// as in 2(3+4).
+	ImplicitMultiplication bool
+
+	// DecimalPrecision is the number of digits after the decimal point
+	// shown for results of decimal mode that have no finite decimal
+	// representation, such as 1/3.
+	DecimalPrecision int
+
+	// Registration rules for logins and passwords.
+	LoginMinLength        int
+	LoginMaxLength        int
+	LoginPattern          string
+	PasswordMinLength     int
+	PasswordMaxLength     int
+	PasswordRequireLower  bool
+	PasswordRequireUpper  bool
+	PasswordRequireDigit  bool
+	PasswordRequireSymbol bool
+}
+
+// defaultJWTKeyID identifies the key configured with JWT_SECRET.
+const defaultJWTKeyID = "default"
+
+// operationTimeEnv maps operators to the variables holding their duration
+// in milliseconds.
+var operationTimeEnv = map[string]string{
+	"+":  "TIME_ADDITION_MS",
+	"-":  "TIME_SUBTRACTION_MS",
+	"*":  "TIME_MULTIPLICATIONS_MS",
+	"/":  "TIME_DIVISIONS_MS",
+	"//": "TIME_INTEGER_DIVISIONS_MS",
+	"%":  "TIME_MODULO_MS",
+	"^":  "TIME_EXPONENTIATIONS_MS",
 }
 
 func Load() (*Config, error) {
@@ -24,9 +113,276 @@ func Load() (*Config, error) {
 		grpcAddress = ":50051"
 	}
 
-	return &Config{
-		ServerAddress: serverAddress,
-		GrpcAddress:   grpcAddress,
-		DatabasePath:  databasePath,
-	}, nil
+	jwtKeys, activeKeyID, err := loadJWTKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	jwtTTL, err := durationEnv("JWT_TTL", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshTTL, err := durationEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseTimeout, err := durationEnv("TASK_LEASE_TIMEOUT", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	reaperInterval, err := durationEnv("LEASE_REAPER_INTERVAL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	workerTimeout, err := durationEnv("WORKER_TIMEOUT", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownTimeout, err := durationEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	agentTokens, err := loadAgentTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	var adminLogins []string
+	if v := os.Getenv("ADMIN_LOGINS"); v != "" {
+		for _, login := range strings.Split(v, ",") {
+			if login = strings.TrimSpace(login); login != "" {
+				adminLogins = append(adminLogins, login)
+			}
+		}
+	}
+
+	loginPattern := os.Getenv("LOGIN_PATTERN")
+	if loginPattern == "" {
+		loginPattern = `[A-Za-z0-9_.-]+`
+	}
+
+	cfg := &Config{
+		ServerAddress:  serverAddress,
+		GrpcAddress:    grpcAddress,
+		DatabasePath:   databasePath,
+		JWTKeys:        jwtKeys,
+		JWTActiveKeyID: activeKeyID,
+		JWTTTL:         jwtTTL,
+		RefreshTTL:     refreshTTL,
+		JWTIssuer:      os.Getenv("JWT_ISSUER"),
+		JWTAudience:    os.Getenv("JWT_AUDIENCE"),
+		LoginPattern:   loginPattern,
+
+		TaskLeaseTimeout:    leaseTimeout,
+		LeaseReaperInterval: reaperInterval,
+		WorkerTimeout:       workerTimeout,
+		ShutdownTimeout:     shutdownTimeout,
+		AdminLogins:         adminLogins,
+
+		GRPCTLSCertFile:  os.Getenv("GRPC_TLS_CERT"),
+		GRPCTLSKeyFile:   os.Getenv("GRPC_TLS_KEY"),
+		GRPCClientCAFile: os.Getenv("GRPC_TLS_CLIENT_CA"),
+		AgentToken:       os.Getenv("AGENT_TOKEN"),
+		AgentTokens:      agentTokens,
+	}
+
+	ints := []struct {
+		name string
+		dst  *int
+		def  int
+	}{
+		{"TASK_MAX_ATTEMPTS", &cfg.TaskMaxAttempts, 3},
+		{"DECIMAL_PRECISION", &cfg.DecimalPrecision, 20},
+		{"LOGIN_MIN_LENGTH", &cfg.LoginMinLength, 3},
+		{"LOGIN_MAX_LENGTH", &cfg.LoginMaxLength, 32},
+		{"PASSWORD_MIN_LENGTH", &cfg.PasswordMinLength, 8},
+		// bcrypt ignores everything after 72 bytes.
+		{"PASSWORD_MAX_LENGTH", &cfg.PasswordMaxLength, 72},
+	}
+	for _, v := range ints {
+		if *v.dst, err = intEnv(v.name, v.def); err != nil {
+			return nil, err
+		}
+	}
+
+	bools := []struct {
+		name string
+		dst  *bool
+		def  bool
+	}{
+		{"IMPLICIT_MULTIPLICATION", &cfg.ImplicitMultiplication, true},
+		{"PASSWORD_REQUIRE_LOWER", &cfg.PasswordRequireLower, true},
+		{"PASSWORD_REQUIRE_UPPER", &cfg.PasswordRequireUpper, false},
+		{"PASSWORD_REQUIRE_DIGIT", &cfg.PasswordRequireDigit, true},
+		{"PASSWORD_REQUIRE_SYMBOL", &cfg.PasswordRequireSymbol, false},
+	}
+	for _, v := range bools {
+		if *v.dst, err = boolEnv(v.name, v.def); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.OperationTimes = make(map[string]time.Duration)
+	for op, name := range operationTimeEnv {
+		ms, err := intEnv(name, 0)
+		if err != nil {
+			return nil, err
+		}
+		cfg.OperationTimes[op] = time.Duration(ms) * time.Millisecond
+	}
+	functionMs, err := intEnv("TIME_FUNCTIONS_MS", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.FunctionTime = time.Duration(functionMs) * time.Millisecond
+
+	if cfg.TaskMaxAttempts < 1 {
+		return nil, errors.New("TASK_MAX_ATTEMPTS must be at least 1")
+	}
+	if cfg.PasswordMaxLength > 72 {
+		return nil, errors.New("PASSWORD_MAX_LENGTH must not exceed 72")
+	}
+	if cfg.DecimalPrecision < 0 {
+		return nil, errors.New("DECIMAL_PRECISION must not be negative")
+	}
+	// An operation that takes longer than its lease would be handed out
+	// again on every attempt until it fails.
+	for op, d := range cfg.OperationTimes {
+		if d >= cfg.TaskLeaseTimeout {
+			return nil, fmt.Errorf("%s must be less than TASK_LEASE_TIMEOUT", operationTimeEnv[op])
+		}
+	}
+	if cfg.FunctionTime >= cfg.TaskLeaseTimeout {
+		return nil, errors.New("TIME_FUNCTIONS_MS must be less than TASK_LEASE_TIMEOUT")
+	}
+	if (cfg.GRPCTLSCertFile == "") != (cfg.GRPCTLSKeyFile == "") {
+		return nil, errors.New("GRPC_TLS_CERT and GRPC_TLS_KEY must be set together")
+	}
+	if cfg.GRPCClientCAFile != "" && cfg.GRPCTLSCertFile == "" {
+		return nil, errors.New("GRPC_TLS_CLIENT_CA requires GRPC_TLS_CERT and GRPC_TLS_KEY")
+	}
+	for id, token := range cfg.AgentTokens {
+		if token == cfg.AgentToken {
+			return nil, fmt.Errorf("token of agent %q must differ from AGENT_TOKEN", id)
+		}
+	}
+
+	return cfg, nil
+}
+
+// loadJWTKeys reads signing keys from JWT_KEYS ("kid1:secret1,kid2:secret2")
+// and JWT_SECRET. The active key is JWT_ACTIVE_KEY_ID, or the first key of
+// JWT_KEYS, or JWT_SECRET when it is the only one.
+func loadJWTKeys() (map[string]string, string, error) {
+	keys := make(map[string]string)
+	var activeKeyID string
+
+	if v := os.Getenv("JWT_KEYS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			kid, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || kid == "" || secret == "" {
+				return nil, "", fmt.Errorf("invalid JWT_KEYS entry %q, expected kid:secret", pair)
+			}
+			if _, exists := keys[kid]; exists {
+				return nil, "", fmt.Errorf("duplicate JWT key id %q", kid)
+			}
+			keys[kid] = secret
+			if activeKeyID == "" {
+				activeKeyID = kid
+			}
+		}
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		if _, exists := keys[defaultJWTKeyID]; exists {
+			return nil, "", fmt.Errorf("JWT_KEYS must not use key id %q together with JWT_SECRET", defaultJWTKeyID)
+		}
+		keys[defaultJWTKeyID] = secret
+		if activeKeyID == "" {
+			activeKeyID = defaultJWTKeyID
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, "", errors.New("JWT_SECRET or JWT_KEYS must be set")
+	}
+
+	if v := os.Getenv("JWT_ACTIVE_KEY_ID"); v != "" {
+		if _, ok := keys[v]; !ok {
+			return nil, "", fmt.Errorf("JWT_ACTIVE_KEY_ID %q is not among the configured keys", v)
+		}
+		activeKeyID = v
+	}
+
+	return keys, activeKeyID, nil
+}
+
+// loadAgentTokens reads per-agent tokens from AGENT_TOKENS
+// ("agent1:token1,agent2:token2"). Tokens must be unique because they
+// identify the agent.
+func loadAgentTokens() (map[string]string, error) {
+	tokens := make(map[string]string)
+	v := os.Getenv("AGENT_TOKENS")
+	if v == "" {
+		return tokens, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(v, ",") {
+		id, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || token == "" {
+			return nil, fmt.Errorf("invalid AGENT_TOKENS entry %q, expected agent:token", pair)
+		}
+		if _, exists := tokens[id]; exists {
+			return nil, fmt.Errorf("duplicate agent id %q in AGENT_TOKENS", id)
+		}
+		if seen[token] {
+			return nil, fmt.Errorf("token of agent %q is used by another agent", id)
+		}
+		seen[token] = true
+		tokens[id] = token
+	}
+	return tokens, nil
+}
+
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+func intEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+func boolEnv(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return b, nil
 }
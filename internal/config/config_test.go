@@ -0,0 +1,270 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setEnv clears every variable Load reads and sets the given ones.
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	names := []string{
+		"DB_PATH", "SERVER_ADDRESS", "GRPC_ADDRESS",
+		"JWT_SECRET", "JWT_KEYS", "JWT_ACTIVE_KEY_ID", "JWT_TTL", "REFRESH_TOKEN_TTL",
+		"JWT_ISSUER", "JWT_AUDIENCE",
+		"TASK_LEASE_TIMEOUT", "LEASE_REAPER_INTERVAL", "TASK_MAX_ATTEMPTS", "WORKER_TIMEOUT", "SHUTDOWN_TIMEOUT",
+		"GRPC_TLS_CERT", "GRPC_TLS_KEY", "GRPC_TLS_CLIENT_CA", "AGENT_TOKEN", "AGENT_TOKENS", "ADMIN_LOGINS",
+		"LOGIN_PATTERN", "LOGIN_MIN_LENGTH", "LOGIN_MAX_LENGTH",
+		"PASSWORD_MIN_LENGTH", "PASSWORD_MAX_LENGTH",
+		"PASSWORD_REQUIRE_LOWER", "PASSWORD_REQUIRE_UPPER",
+		"PASSWORD_REQUIRE_DIGIT", "PASSWORD_REQUIRE_SYMBOL",
+		"IMPLICIT_MULTIPLICATION", "TIME_FUNCTIONS_MS", "DECIMAL_PRECISION",
+	}
+	for _, name := range operationTimeEnv {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		t.Setenv(name, "")
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	setEnv(t, map[string]string{"JWT_SECRET": "secret"})
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.DatabasePath != "./calc.db" || cfg.ServerAddress != ":8080" || cfg.GrpcAddress != ":50051" {
+		t.Errorf("Load() addresses = %q, %q, %q", cfg.DatabasePath, cfg.ServerAddress, cfg.GrpcAddress)
+	}
+	if !reflect.DeepEqual(cfg.JWTKeys, map[string]string{"default": "secret"}) || cfg.JWTActiveKeyID != "default" {
+		t.Errorf("Load() JWT keys = %v, active %q", cfg.JWTKeys, cfg.JWTActiveKeyID)
+	}
+	if cfg.JWTTTL != 15*time.Minute || cfg.RefreshTTL != 30*24*time.Hour {
+		t.Errorf("Load() JWTTTL = %v, RefreshTTL = %v", cfg.JWTTTL, cfg.RefreshTTL)
+	}
+	if cfg.TaskLeaseTimeout != time.Minute || cfg.LeaseReaperInterval != 5*time.Second || cfg.TaskMaxAttempts != 3 {
+		t.Errorf("Load() TaskLeaseTimeout = %v, LeaseReaperInterval = %v, TaskMaxAttempts = %d",
+			cfg.TaskLeaseTimeout, cfg.LeaseReaperInterval, cfg.TaskMaxAttempts)
+	}
+	for op, d := range cfg.OperationTimes {
+		if d != 0 {
+			t.Errorf("Load() time of %s = %v, want 0", op, d)
+		}
+	}
+	if !cfg.ImplicitMultiplication {
+		t.Error("Load() ImplicitMultiplication = false, want true")
+	}
+	if cfg.DecimalPrecision != 20 {
+		t.Errorf("Load() DecimalPrecision = %d, want 20", cfg.DecimalPrecision)
+	}
+	if cfg.PasswordMinLength != 8 || cfg.PasswordMaxLength != 72 || !cfg.PasswordRequireDigit || cfg.PasswordRequireUpper {
+		t.Errorf("Load() password rules = %d..%d, digit %v, upper %v",
+			cfg.PasswordMinLength, cfg.PasswordMaxLength, cfg.PasswordRequireDigit, cfg.PasswordRequireUpper)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "JWT key rotation",
+			env:  map[string]string{"JWT_KEYS": "k2:new, k1:old", "JWT_SECRET": "legacy"},
+			check: func(t *testing.T, cfg *Config) {
+				want := map[string]string{"k2": "new", "k1": "old", "default": "legacy"}
+				if !reflect.DeepEqual(cfg.JWTKeys, want) {
+					t.Errorf("JWTKeys = %v, want %v", cfg.JWTKeys, want)
+				}
+				if cfg.JWTActiveKeyID != "k2" {
+					t.Errorf("JWTActiveKeyID = %q, want %q", cfg.JWTActiveKeyID, "k2")
+				}
+			},
+		},
+		{
+			name: "active JWT key",
+			env:  map[string]string{"JWT_KEYS": "k2:new,k1:old", "JWT_ACTIVE_KEY_ID": "k1"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.JWTActiveKeyID != "k1" {
+					t.Errorf("JWTActiveKeyID = %q, want %q", cfg.JWTActiveKeyID, "k1")
+				}
+			},
+		},
+		{
+			name: "admin logins",
+			env:  map[string]string{"JWT_SECRET": "secret", "ADMIN_LOGINS": " admin, ,ops "},
+			check: func(t *testing.T, cfg *Config) {
+				if want := []string{"admin", "ops"}; !reflect.DeepEqual(cfg.AdminLogins, want) {
+					t.Errorf("AdminLogins = %v, want %v", cfg.AdminLogins, want)
+				}
+			},
+		},
+		{
+			name: "durations",
+			env: map[string]string{
+				"JWT_SECRET":         "secret",
+				"JWT_TTL":            "5m",
+				"REFRESH_TOKEN_TTL":  "24h",
+				"TASK_LEASE_TIMEOUT": "30s",
+				"WORKER_TIMEOUT":     "1m",
+				"SHUTDOWN_TIMEOUT":   "10s",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.JWTTTL != 5*time.Minute || cfg.RefreshTTL != 24*time.Hour || cfg.TaskLeaseTimeout != 30*time.Second {
+					t.Errorf("JWTTTL = %v, RefreshTTL = %v, TaskLeaseTimeout = %v",
+						cfg.JWTTTL, cfg.RefreshTTL, cfg.TaskLeaseTimeout)
+				}
+				if cfg.WorkerTimeout != time.Minute || cfg.ShutdownTimeout != 10*time.Second {
+					t.Errorf("WorkerTimeout = %v, ShutdownTimeout = %v", cfg.WorkerTimeout, cfg.ShutdownTimeout)
+				}
+			},
+		},
+		{
+			name: "operation times",
+			env: map[string]string{
+				"JWT_SECRET":              "secret",
+				"TIME_ADDITION_MS":        "100",
+				"TIME_MULTIPLICATIONS_MS": "2500",
+				"TIME_EXPONENTIATIONS_MS": "300",
+				"TIME_FUNCTIONS_MS":       "700",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.OperationTimes["+"] != 100*time.Millisecond || cfg.OperationTimes["*"] != 2500*time.Millisecond ||
+					cfg.OperationTimes["^"] != 300*time.Millisecond || cfg.OperationTimes["-"] != 0 {
+					t.Errorf("OperationTimes = %v", cfg.OperationTimes)
+				}
+				if cfg.FunctionTime != 700*time.Millisecond {
+					t.Errorf("FunctionTime = %v, want %v", cfg.FunctionTime, 700*time.Millisecond)
+				}
+			},
+		},
+		{
+			name: "agent authentication",
+			env: map[string]string{
+				"JWT_SECRET":         "secret",
+				"GRPC_TLS_CERT":      "server.crt",
+				"GRPC_TLS_KEY":       "server.key",
+				"GRPC_TLS_CLIENT_CA": "ca.crt",
+				"AGENT_TOKEN":        "shared",
+				"AGENT_TOKENS":       "agent-1:token-1, agent-2:token-2",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.GRPCTLSCertFile != "server.crt" || cfg.GRPCTLSKeyFile != "server.key" || cfg.GRPCClientCAFile != "ca.crt" {
+					t.Errorf("TLS files = %q, %q, %q", cfg.GRPCTLSCertFile, cfg.GRPCTLSKeyFile, cfg.GRPCClientCAFile)
+				}
+				want := map[string]string{"agent-1": "token-1", "agent-2": "token-2"}
+				if cfg.AgentToken != "shared" || !reflect.DeepEqual(cfg.AgentTokens, want) {
+					t.Errorf("AgentToken = %q, AgentTokens = %v", cfg.AgentToken, cfg.AgentTokens)
+				}
+			},
+		},
+		{
+			name: "explicit multiplication",
+			env:  map[string]string{"JWT_SECRET": "secret", "IMPLICIT_MULTIPLICATION": "false"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.ImplicitMultiplication {
+					t.Error("ImplicitMultiplication = true, want false")
+				}
+			},
+		},
+		{
+			name: "JWT claims",
+			env: map[string]string{
+				"JWT_SECRET":   "secret",
+				"JWT_ISSUER":   "calc-service",
+				"JWT_AUDIENCE": "calc-users",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.JWTIssuer != "calc-service" || cfg.JWTAudience != "calc-users" {
+					t.Errorf("JWTIssuer = %q, JWTAudience = %q", cfg.JWTIssuer, cfg.JWTAudience)
+				}
+			},
+		},
+		{
+			name: "registration rules",
+			env: map[string]string{
+				"JWT_SECRET":             "secret",
+				"LOGIN_PATTERN":          "[a-z]+",
+				"LOGIN_MIN_LENGTH":       "5",
+				"PASSWORD_REQUIRE_UPPER": "1",
+				"PASSWORD_REQUIRE_LOWER": "false",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.LoginPattern != "[a-z]+" || cfg.LoginMinLength != 5 {
+					t.Errorf("LoginPattern = %q, LoginMinLength = %d", cfg.LoginPattern, cfg.LoginMinLength)
+				}
+				if !cfg.PasswordRequireUpper || cfg.PasswordRequireLower {
+					t.Errorf("PasswordRequireUpper = %v, PasswordRequireLower = %v",
+						cfg.PasswordRequireUpper, cfg.PasswordRequireLower)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			cfg, err := Load()
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{"no JWT key", nil, "JWT_SECRET or JWT_KEYS must be set"},
+		{"JWT key without secret", map[string]string{"JWT_KEYS": "k1:"}, "invalid JWT_KEYS entry"},
+		{"duplicate JWT key", map[string]string{"JWT_KEYS": "k1:a,k1:b"}, "duplicate JWT key id"},
+		{"JWT key id of JWT_SECRET", map[string]string{"JWT_KEYS": "default:a", "JWT_SECRET": "b"}, "must not use key id"},
+		{"unknown active JWT key", map[string]string{"JWT_SECRET": "a", "JWT_ACTIVE_KEY_ID": "k9"}, "JWT_ACTIVE_KEY_ID"},
+		{"invalid duration", map[string]string{"JWT_SECRET": "a", "JWT_TTL": "15"}, "invalid JWT_TTL"},
+		{"negative duration", map[string]string{"JWT_SECRET": "a", "TASK_LEASE_TIMEOUT": "-1s"}, "invalid TASK_LEASE_TIMEOUT"},
+		{"invalid integer", map[string]string{"JWT_SECRET": "a", "TIME_ADDITION_MS": "fast"}, "invalid TIME_ADDITION_MS"},
+		{"negative integer", map[string]string{"JWT_SECRET": "a", "PASSWORD_MIN_LENGTH": "-1"}, "invalid PASSWORD_MIN_LENGTH"},
+		{"negative decimal precision", map[string]string{"JWT_SECRET": "a", "DECIMAL_PRECISION": "-1"}, "invalid DECIMAL_PRECISION"},
+		{"invalid boolean", map[string]string{"JWT_SECRET": "a", "PASSWORD_REQUIRE_DIGIT": "maybe"}, "invalid PASSWORD_REQUIRE_DIGIT"},
+		{
+			"operation longer than the lease",
+			map[string]string{"JWT_SECRET": "a", "TASK_LEASE_TIMEOUT": "10s", "TIME_DIVISIONS_MS": "10000"},
+			"TIME_DIVISIONS_MS must be less than TASK_LEASE_TIMEOUT",
+		},
+		{
+			"function longer than the lease",
+			map[string]string{"JWT_SECRET": "a", "TASK_LEASE_TIMEOUT": "1s", "TIME_FUNCTIONS_MS": "1500"},
+			"TIME_FUNCTIONS_MS must be less than TASK_LEASE_TIMEOUT",
+		},
+		{"TLS certificate without key", map[string]string{"JWT_SECRET": "a", "GRPC_TLS_CERT": "server.crt"}, "must be set together"},
+		{"client CA without TLS", map[string]string{"JWT_SECRET": "a", "GRPC_TLS_CLIENT_CA": "ca.crt"}, "GRPC_TLS_CLIENT_CA"},
+		{"agent token without ID", map[string]string{"JWT_SECRET": "a", "AGENT_TOKENS": ":token"}, "invalid AGENT_TOKENS entry"},
+		{"duplicate agent", map[string]string{"JWT_SECRET": "a", "AGENT_TOKENS": "a1:t1,a1:t2"}, "duplicate agent id"},
+		{"shared agent token", map[string]string{"JWT_SECRET": "a", "AGENT_TOKENS": "a1:t,a2:t"}, "used by another agent"},
+		{"agent token of AGENT_TOKEN", map[string]string{"JWT_SECRET": "a", "AGENT_TOKEN": "t", "AGENT_TOKENS": "a1:t"}, "must differ from AGENT_TOKEN"},
+		{"no attempts", map[string]string{"JWT_SECRET": "a", "TASK_MAX_ATTEMPTS": "0"}, "TASK_MAX_ATTEMPTS"},
+		{"long passwords", map[string]string{"JWT_SECRET": "a", "PASSWORD_MAX_LENGTH": "100"}, "PASSWORD_MAX_LENGTH"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			_, err := Load()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ const (
 type TaskRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	WorkerId      string                 `protobuf:"bytes,1,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	Capacity      int32                  `protobuf:"varint,2,opt,name=capacity,proto3" json:"capacity,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -65,12 +66,31 @@ func (x *TaskRequest) GetWorkerId() string {
 	return ""
 }
 
+func (x *TaskRequest) GetCapacity() int32 {
+	if x != nil {
+		return x.Capacity
+	}
+	return 0
+}
+
 type TaskResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Arg1          string                 `protobuf:"bytes,2,opt,name=arg1,proto3" json:"arg1,omitempty"`
-	Arg2          string                 `protobuf:"bytes,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
-	Operation     string                 `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Arg1  string                 `protobuf:"bytes,2,opt,name=arg1,proto3" json:"arg1,omitempty"`
+	Arg2  string                 `protobuf:"bytes,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
+	// One of "+", "-", "*", "/", "//" (floor division), "%" (remainder of
+	// floor division), "^" (exponentiation) or the name of a built-in
+	// function such as "sqrt" or "max".
+	Operation       string `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
+	OperationTimeMs int64  `protobuf:"varint,5,opt,name=operation_time_ms,json=operationTimeMs,proto3" json:"operation_time_ms,omitempty"`
+	// All arguments of the operation. arg1 and arg2 repeat the first two for
+	// agents that only know binary operators.
+	Args []string `protobuf:"bytes,6,rep,name=args,proto3" json:"args,omitempty"`
+	// Arithmetic to compute the operation with: "float" (the default when
+	// empty), "decimal", in which arguments and the result are exact
+	// fractions such as "1/3", or "complex", in which they are complex
+	// numbers such as "1+2i", "-2i" or "3".
+	Mode          string `protobuf:"bytes,7,opt,name=mode,proto3" json:"mode,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -133,10 +153,36 @@ func (x *TaskResponse) GetOperation() string {
 	return ""
 }
 
+func (x *TaskResponse) GetOperationTimeMs() int64 {
+	if x != nil {
+		return x.OperationTimeMs
+	}
+	return 0
+}
+
+func (x *TaskResponse) GetArgs() []string {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *TaskResponse) GetMode() string {
+	if x != nil {
+		return x.Mode
+	}
+	return ""
+}
+
 type ResultRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Result        float64                `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// Result of agents that do not set value; only used when value is empty.
+	// It cannot hold complex results.
+	Result   float64 `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
+	WorkerId string  `protobuf:"bytes,3,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	// Result formatted as in the arguments of the operation.
+	Value         string `protobuf:"bytes,4,opt,name=value,proto3" json:"value,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -185,6 +231,80 @@ func (x *ResultRequest) GetResult() float64 {
 	return 0
 }
 
+func (x *ResultRequest) GetWorkerId() string {
+	if x != nil {
+		return x.WorkerId
+	}
+	return ""
+}
+
+func (x *ResultRequest) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+type ErrorRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Error         string                 `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	WorkerId      string                 `protobuf:"bytes,3,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ErrorRequest) Reset() {
+	*x = ErrorRequest{}
+	mi := &file_calculator_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ErrorRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ErrorRequest) ProtoMessage() {}
+
+func (x *ErrorRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_calculator_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ErrorRequest.ProtoReflect.Descriptor instead.
+func (*ErrorRequest) Descriptor() ([]byte, []int) {
+	return file_calculator_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ErrorRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *ErrorRequest) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *ErrorRequest) GetWorkerId() string {
+	if x != nil {
+		return x.WorkerId
+	}
+	return ""
+}
+
 type ResultResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
@@ -194,7 +314,7 @@ type ResultResponse struct {
 
 func (x *ResultResponse) Reset() {
 	*x = ResultResponse{}
-	mi := &file_calculator_proto_msgTypes[3]
+	mi := &file_calculator_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -206,7 +326,7 @@ func (x *ResultResponse) String() string {
 func (*ResultResponse) ProtoMessage() {}
 
 func (x *ResultResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_calculator_proto_msgTypes[3]
+	mi := &file_calculator_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -219,7 +339,7 @@ func (x *ResultResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ResultResponse.ProtoReflect.Descriptor instead.
 func (*ResultResponse) Descriptor() ([]byte, []int) {
-	return file_calculator_proto_rawDescGZIP(), []int{3}
+	return file_calculator_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *ResultResponse) GetSuccess() bool {
@@ -229,27 +349,343 @@ func (x *ResultResponse) GetSuccess() bool {
 	return false
 }
 
+type WorkerHello struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	WorkerId      string                 `protobuf:"bytes,1,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	Capacity      int32                  `protobuf:"varint,2,opt,name=capacity,proto3" json:"capacity,omitempty"`
+	Hostname      string                 `protobuf:"bytes,3,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WorkerHello) Reset() {
+	*x = WorkerHello{}
+	mi := &file_calculator_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WorkerHello) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WorkerHello) ProtoMessage() {}
+
+func (x *WorkerHello) ProtoReflect() protoreflect.Message {
+	mi := &file_calculator_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WorkerHello.ProtoReflect.Descriptor instead.
+func (*WorkerHello) Descriptor() ([]byte, []int) {
+	return file_calculator_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *WorkerHello) GetWorkerId() string {
+	if x != nil {
+		return x.WorkerId
+	}
+	return ""
+}
+
+func (x *WorkerHello) GetCapacity() int32 {
+	if x != nil {
+		return x.Capacity
+	}
+	return 0
+}
+
+func (x *WorkerHello) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+type WorkerMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*WorkerMessage_Hello
+	//	*WorkerMessage_Ready
+	//	*WorkerMessage_Result
+	//	*WorkerMessage_Error
+	//	*WorkerMessage_Drain
+	//	*WorkerMessage_Heartbeat
+	Payload       isWorkerMessage_Payload `protobuf_oneof:"payload"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WorkerMessage) Reset() {
+	*x = WorkerMessage{}
+	mi := &file_calculator_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WorkerMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WorkerMessage) ProtoMessage() {}
+
+func (x *WorkerMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_calculator_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WorkerMessage.ProtoReflect.Descriptor instead.
+func (*WorkerMessage) Descriptor() ([]byte, []int) {
+	return file_calculator_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *WorkerMessage) GetPayload() isWorkerMessage_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *WorkerMessage) GetHello() *WorkerHello {
+	if x != nil {
+		if x, ok := x.Payload.(*WorkerMessage_Hello); ok {
+			return x.Hello
+		}
+	}
+	return nil
+}
+
+func (x *WorkerMessage) GetReady() int32 {
+	if x != nil {
+		if x, ok := x.Payload.(*WorkerMessage_Ready); ok {
+			return x.Ready
+		}
+	}
+	return 0
+}
+
+func (x *WorkerMessage) GetResult() *ResultRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*WorkerMessage_Result); ok {
+			return x.Result
+		}
+	}
+	return nil
+}
+
+func (x *WorkerMessage) GetError() *ErrorRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*WorkerMessage_Error); ok {
+			return x.Error
+		}
+	}
+	return nil
+}
+
+func (x *WorkerMessage) GetDrain() bool {
+	if x != nil {
+		if x, ok := x.Payload.(*WorkerMessage_Drain); ok {
+			return x.Drain
+		}
+	}
+	return false
+}
+
+func (x *WorkerMessage) GetHeartbeat() bool {
+	if x != nil {
+		if x, ok := x.Payload.(*WorkerMessage_Heartbeat); ok {
+			return x.Heartbeat
+		}
+	}
+	return false
+}
+
+type isWorkerMessage_Payload interface {
+	isWorkerMessage_Payload()
+}
+
+type WorkerMessage_Hello struct {
+	Hello *WorkerHello `protobuf:"bytes,1,opt,name=hello,proto3,oneof"`
+}
+
+type WorkerMessage_Ready struct {
+	Ready int32 `protobuf:"varint,2,opt,name=ready,proto3,oneof"`
+}
+
+type WorkerMessage_Result struct {
+	Result *ResultRequest `protobuf:"bytes,3,opt,name=result,proto3,oneof"`
+}
+
+type WorkerMessage_Error struct {
+	Error *ErrorRequest `protobuf:"bytes,4,opt,name=error,proto3,oneof"`
+}
+
+type WorkerMessage_Drain struct {
+	Drain bool `protobuf:"varint,5,opt,name=drain,proto3,oneof"`
+}
+
+type WorkerMessage_Heartbeat struct {
+	Heartbeat bool `protobuf:"varint,6,opt,name=heartbeat,proto3,oneof"`
+}
+
+func (*WorkerMessage_Hello) isWorkerMessage_Payload() {}
+
+func (*WorkerMessage_Ready) isWorkerMessage_Payload() {}
+
+func (*WorkerMessage_Result) isWorkerMessage_Payload() {}
+
+func (*WorkerMessage_Error) isWorkerMessage_Payload() {}
+
+func (*WorkerMessage_Drain) isWorkerMessage_Payload() {}
+
+func (*WorkerMessage_Heartbeat) isWorkerMessage_Payload() {}
+
+type ServerMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*ServerMessage_Task
+	//	*ServerMessage_Drained
+	Payload       isServerMessage_Payload `protobuf_oneof:"payload"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ServerMessage) Reset() {
+	*x = ServerMessage{}
+	mi := &file_calculator_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServerMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServerMessage) ProtoMessage() {}
+
+func (x *ServerMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_calculator_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServerMessage.ProtoReflect.Descriptor instead.
+func (*ServerMessage) Descriptor() ([]byte, []int) {
+	return file_calculator_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ServerMessage) GetPayload() isServerMessage_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *ServerMessage) GetTask() *TaskResponse {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerMessage_Task); ok {
+			return x.Task
+		}
+	}
+	return nil
+}
+
+func (x *ServerMessage) GetDrained() bool {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerMessage_Drained); ok {
+			return x.Drained
+		}
+	}
+	return false
+}
+
+type isServerMessage_Payload interface {
+	isServerMessage_Payload()
+}
+
+type ServerMessage_Task struct {
+	Task *TaskResponse `protobuf:"bytes,1,opt,name=task,proto3,oneof"`
+}
+
+type ServerMessage_Drained struct {
+	Drained bool `protobuf:"varint,2,opt,name=drained,proto3,oneof"`
+}
+
+func (*ServerMessage_Task) isServerMessage_Payload() {}
+
+func (*ServerMessage_Drained) isServerMessage_Payload() {}
+
 var File_calculator_proto protoreflect.FileDescriptor
 
 const file_calculator_proto_rawDesc = "" +
 	"\n" +
-	"\x10calculator.proto\"*\n" +
+	"\x10calculator.proto\"F\n" +
 	"\vTaskRequest\x12\x1b\n" +
-	"\tworker_id\x18\x01 \x01(\tR\bworkerId\"d\n" +
+	"\tworker_id\x18\x01 \x01(\tR\bworkerId\x12\x1a\n" +
+	"\bcapacity\x18\x02 \x01(\x05R\bcapacity\"\xb8\x01\n" +
 	"\fTaskResponse\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
 	"\x04arg1\x18\x02 \x01(\tR\x04arg1\x12\x12\n" +
 	"\x04arg2\x18\x03 \x01(\tR\x04arg2\x12\x1c\n" +
-	"\toperation\x18\x04 \x01(\tR\toperation\"7\n" +
+	"\toperation\x18\x04 \x01(\tR\toperation\x12*\n" +
+	"\x11operation_time_ms\x18\x05 \x01(\x03R\x0foperationTimeMs\x12\x12\n" +
+	"\x04args\x18\x06 \x03(\tR\x04args\x12\x12\n" +
+	"\x04mode\x18\a \x01(\tR\x04mode\"j\n" +
 	"\rResultRequest\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
-	"\x06result\x18\x02 \x01(\x01R\x06result\"*\n" +
+	"\x06result\x18\x02 \x01(\x01R\x06result\x12\x1b\n" +
+	"\tworker_id\x18\x03 \x01(\tR\bworkerId\x12\x14\n" +
+	"\x05value\x18\x04 \x01(\tR\x05value\"Q\n" +
+	"\fErrorRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x14\n" +
+	"\x05error\x18\x02 \x01(\tR\x05error\x12\x1b\n" +
+	"\tworker_id\x18\x03 \x01(\tR\bworkerId\"*\n" +
 	"\x0eResultResponse\x12\x18\n" +
-	"\asuccess\x18\x01 \x01(\bR\asuccess2e\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\"b\n" +
+	"\vWorkerHello\x12\x1b\n" +
+	"\tworker_id\x18\x01 \x01(\tR\bworkerId\x12\x1a\n" +
+	"\bcapacity\x18\x02 \x01(\x05R\bcapacity\x12\x1a\n" +
+	"\bhostname\x18\x03 \x01(\tR\bhostname\"\xe1\x01\n" +
+	"\rWorkerMessage\x12$\n" +
+	"\x05hello\x18\x01 \x01(\v2\f.WorkerHelloH\x00R\x05hello\x12\x16\n" +
+	"\x05ready\x18\x02 \x01(\x05H\x00R\x05ready\x12(\n" +
+	"\x06result\x18\x03 \x01(\v2\x0e.ResultRequestH\x00R\x06result\x12%\n" +
+	"\x05error\x18\x04 \x01(\v2\r.ErrorRequestH\x00R\x05error\x12\x16\n" +
+	"\x05drain\x18\x05 \x01(\bH\x00R\x05drain\x12\x1e\n" +
+	"\theartbeat\x18\x06 \x01(\bH\x00R\theartbeatB\t\n" +
+	"\apayload\"[\n" +
+	"\rServerMessage\x12#\n" +
+	"\x04task\x18\x01 \x01(\v2\r.TaskResponseH\x00R\x04task\x12\x1a\n" +
+	"\adrained\x18\x02 \x01(\bH\x00R\adrainedB\t\n" +
+	"\apayload2\xc3\x01\n" +
 	"\n" +
 	"Calculator\x12&\n" +
 	"\aGetTask\x12\f.TaskRequest\x1a\r.TaskResponse\x12/\n" +
-	"\fSubmitResult\x12\x0e.ResultRequest\x1a\x0f.ResultResponseB0Z.github.com/zubrodin/calc-service/internal/grpcb\x06proto3"
+	"\fSubmitResult\x12\x0e.ResultRequest\x1a\x0f.ResultResponse\x12-\n" +
+	"\vReportError\x12\r.ErrorRequest\x1a\x0f.ResultResponse\x12-\n" +
+	"\aConnect\x12\x0e.WorkerMessage\x1a\x0e.ServerMessage(\x010\x01B0Z.github.com/zubrodin/calc-service/internal/grpcb\x06proto3"
 
 var (
 	file_calculator_proto_rawDescOnce sync.Once
@@ -263,23 +699,35 @@ func file_calculator_proto_rawDescGZIP() []byte {
 	return file_calculator_proto_rawDescData
 }
 
-var file_calculator_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_calculator_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
 var file_calculator_proto_goTypes = []any{
 	(*TaskRequest)(nil),    // 0: TaskRequest
 	(*TaskResponse)(nil),   // 1: TaskResponse
 	(*ResultRequest)(nil),  // 2: ResultRequest
-	(*ResultResponse)(nil), // 3: ResultResponse
+	(*ErrorRequest)(nil),   // 3: ErrorRequest
+	(*ResultResponse)(nil), // 4: ResultResponse
+	(*WorkerHello)(nil),    // 5: WorkerHello
+	(*WorkerMessage)(nil),  // 6: WorkerMessage
+	(*ServerMessage)(nil),  // 7: ServerMessage
 }
 var file_calculator_proto_depIdxs = []int32{
-	0, // 0: Calculator.GetTask:input_type -> TaskRequest
-	2, // 1: Calculator.SubmitResult:input_type -> ResultRequest
-	1, // 2: Calculator.GetTask:output_type -> TaskResponse
-	3, // 3: Calculator.SubmitResult:output_type -> ResultResponse
-	2, // [2:4] is the sub-list for method output_type
-	0, // [0:2] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	5, // 0: WorkerMessage.hello:type_name -> WorkerHello
+	2, // 1: WorkerMessage.result:type_name -> ResultRequest
+	3, // 2: WorkerMessage.error:type_name -> ErrorRequest
+	1, // 3: ServerMessage.task:type_name -> TaskResponse
+	0, // 4: Calculator.GetTask:input_type -> TaskRequest
+	2, // 5: Calculator.SubmitResult:input_type -> ResultRequest
+	3, // 6: Calculator.ReportError:input_type -> ErrorRequest
+	6, // 7: Calculator.Connect:input_type -> WorkerMessage
+	1, // 8: Calculator.GetTask:output_type -> TaskResponse
+	4, // 9: Calculator.SubmitResult:output_type -> ResultResponse
+	4, // 10: Calculator.ReportError:output_type -> ResultResponse
+	7, // 11: Calculator.Connect:output_type -> ServerMessage
+	8, // [8:12] is the sub-list for method output_type
+	4, // [4:8] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_calculator_proto_init() }
@@ -287,13 +735,25 @@ func file_calculator_proto_init() {
 	if File_calculator_proto != nil {
 		return
 	}
+	file_calculator_proto_msgTypes[6].OneofWrappers = []any{
+		(*WorkerMessage_Hello)(nil),
+		(*WorkerMessage_Ready)(nil),
+		(*WorkerMessage_Result)(nil),
+		(*WorkerMessage_Error)(nil),
+		(*WorkerMessage_Drain)(nil),
+		(*WorkerMessage_Heartbeat)(nil),
+	}
+	file_calculator_proto_msgTypes[7].OneofWrappers = []any{
+		(*ServerMessage_Task)(nil),
+		(*ServerMessage_Drained)(nil),
+	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_calculator_proto_rawDesc), len(file_calculator_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   8,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
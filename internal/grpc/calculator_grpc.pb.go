@@ -21,6 +21,8 @@ const _ = grpc.SupportPackageIsVersion9
 const (
 	Calculator_GetTask_FullMethodName      = "/Calculator/GetTask"
 	Calculator_SubmitResult_FullMethodName = "/Calculator/SubmitResult"
+	Calculator_ReportError_FullMethodName  = "/Calculator/ReportError"
+	Calculator_Connect_FullMethodName      = "/Calculator/Connect"
 )
 
 // CalculatorClient is the client API for Calculator service.
@@ -29,6 +31,8 @@ const (
 type CalculatorClient interface {
 	GetTask(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*TaskResponse, error)
 	SubmitResult(ctx context.Context, in *ResultRequest, opts ...grpc.CallOption) (*ResultResponse, error)
+	ReportError(ctx context.Context, in *ErrorRequest, opts ...grpc.CallOption) (*ResultResponse, error)
+	Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[WorkerMessage, ServerMessage], error)
 }
 
 type calculatorClient struct {
@@ -59,12 +63,37 @@ func (c *calculatorClient) SubmitResult(ctx context.Context, in *ResultRequest,
 	return out, nil
 }
 
+func (c *calculatorClient) ReportError(ctx context.Context, in *ErrorRequest, opts ...grpc.CallOption) (*ResultResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ResultResponse)
+	err := c.cc.Invoke(ctx, Calculator_ReportError_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *calculatorClient) Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[WorkerMessage, ServerMessage], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Calculator_ServiceDesc.Streams[0], Calculator_Connect_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WorkerMessage, ServerMessage]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Calculator_ConnectClient = grpc.BidiStreamingClient[WorkerMessage, ServerMessage]
+
 // CalculatorServer is the server API for Calculator service.
 // All implementations must embed UnimplementedCalculatorServer
 // for forward compatibility.
 type CalculatorServer interface {
 	GetTask(context.Context, *TaskRequest) (*TaskResponse, error)
 	SubmitResult(context.Context, *ResultRequest) (*ResultResponse, error)
+	ReportError(context.Context, *ErrorRequest) (*ResultResponse, error)
+	Connect(grpc.BidiStreamingServer[WorkerMessage, ServerMessage]) error
 	mustEmbedUnimplementedCalculatorServer()
 }
 
@@ -81,6 +110,12 @@ func (UnimplementedCalculatorServer) GetTask(context.Context, *TaskRequest) (*Ta
 func (UnimplementedCalculatorServer) SubmitResult(context.Context, *ResultRequest) (*ResultResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SubmitResult not implemented")
 }
+func (UnimplementedCalculatorServer) ReportError(context.Context, *ErrorRequest) (*ResultResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReportError not implemented")
+}
+func (UnimplementedCalculatorServer) Connect(grpc.BidiStreamingServer[WorkerMessage, ServerMessage]) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
 func (UnimplementedCalculatorServer) mustEmbedUnimplementedCalculatorServer() {}
 func (UnimplementedCalculatorServer) testEmbeddedByValue()                    {}
 
@@ -138,6 +173,31 @@ func _Calculator_SubmitResult_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Calculator_ReportError_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ErrorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServer).ReportError(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculator_ReportError_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServer).ReportError(ctx, req.(*ErrorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Calculator_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CalculatorServer).Connect(&grpc.GenericServerStream[WorkerMessage, ServerMessage]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Calculator_ConnectServer = grpc.BidiStreamingServer[WorkerMessage, ServerMessage]
+
 // Calculator_ServiceDesc is the grpc.ServiceDesc for Calculator service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -153,7 +213,18 @@ var Calculator_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "SubmitResult",
 			Handler:    _Calculator_SubmitResult_Handler,
 		},
+		{
+			MethodName: "ReportError",
+			Handler:    _Calculator_ReportError_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _Calculator_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "calculator.proto",
 }
@@ -1,33 +1,123 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/zubrodin/calc-service/internal/auth"
 	"github.com/zubrodin/calc-service/internal/repository"
 	"github.com/zubrodin/calc-service/internal/service"
+	"github.com/zubrodin/calc-service/pkg/calculator"
+	"github.com/zubrodin/calc-service/pkg/validator"
 )
 
 type Handler struct {
-	service *service.Service
-	repo    repository.Repository
+	service     *service.Service
+	repo        repository.Repository
+	auth        *auth.Auth
+	credentials *validator.CredentialsValidator
+
+	// workerTimeout is how long an agent may stay silent and still be alive.
+	workerTimeout time.Duration
+	// decimalPrecision is the number of digits shown after the decimal
+	// point of decimal results that have no finite decimal representation.
+	decimalPrecision int
+	// admins are the logins of operators.
+	admins map[string]bool
 }
 
-func New(s *service.Service, repo repository.Repository) *Handler {
+func New(s *service.Service, repo repository.Repository, a *auth.Auth, credentials *validator.CredentialsValidator, workerTimeout time.Duration, decimalPrecision int, adminLogins []string) *Handler {
+	admins := make(map[string]bool, len(adminLogins))
+	for _, login := range adminLogins {
+		admins[login] = true
+	}
 	return &Handler{
-		service: s,
-		repo:    repo,
+		service:          s,
+		repo:             repo,
+		auth:             a,
+		credentials:      credentials,
+		workerTimeout:    workerTimeout,
+		decimalPrecision: decimalPrecision,
+		admins:           admins,
 	}
 }
 
+// CalculateRequest submits an expression. Mode is "float" (the default),
+// "decimal" or "complex".
 type CalculateRequest struct {
 	Expression string `json:"expression"`
+	Mode       string `json:"mode,omitempty"`
 }
 
+// maxCalculateBody limits the size of a CalculateRequest, and so the number
+// of operations an expression is split into.
+const maxCalculateBody = 64 << 10
+
 type CalculateResponse struct {
-	Result float64 `json:"result,omitempty"`
-	Error  string  `json:"error,omitempty"`
+	ID string `json:"id"`
+}
+
+// Expression is a submitted expression. Result is a number in float mode
+// and a string with the exact decimal in decimal mode.
+type Expression struct {
+	ID          string     `json:"id"`
+	Expression  string     `json:"expression"`
+	Mode        string     `json:"mode"`
+	Status      string     `json:"status"`
+	Result      any        `json:"result,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type ExpressionsResponse struct {
+	Expressions []Expression `json:"expressions"`
+}
+
+type ExpressionResponse struct {
+	Expression Expression `json:"expression"`
+}
+
+type Worker struct {
+	ID           string    `json:"id"`
+	Hostname     string    `json:"hostname,omitempty"`
+	Capacity     int       `json:"capacity"`
+	Status       string    `json:"status"`
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeen     time.Time `json:"last_seen"`
+	Tasks        []string  `json:"tasks"`
+}
+
+type WorkersResponse struct {
+	Workers []Worker `json:"workers"`
+}
+
+// Variable reports a value as a JSON number if a number represents it
+// exactly, and as a string such as "1/3" or "1+2i" otherwise.
+type Variable struct {
+	Name      string    `json:"name"`
+	Value     any       `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type VariablesResponse struct {
+	Variables []Variable `json:"variables"`
+}
+
+type VariableResponse struct {
+	Variable Variable `json:"variable"`
+}
+
+// SetVariableRequest sets a variable to a JSON number, kept as written, or
+// to a string holding a fraction or a complex number.
+type SetVariableRequest struct {
+	Value json.RawMessage `json:"value"`
 }
 
 type RegisterRequest struct {
@@ -35,13 +125,39 @@ type RegisterRequest struct {
 	Password string `json:"password"`
 }
 
+type ValidationErrorResponse struct {
+	Error  string                `json:"error"`
+	Fields validator.FieldErrors `json:"fields"`
+}
+
+// ExpressionErrorResponse locates the error in an expression: Offset is the
+// byte offset in it, Snippet the line with a caret under the error.
+type ExpressionErrorResponse struct {
+	Error    string `json:"error"`
+	Message  string `json:"message"`
+	Offset   int    `json:"offset"`
+	Expected string `json:"expected,omitempty"`
+	Found    string `json:"found,omitempty"`
+	Snippet  string `json:"snippet"`
+}
+
 type LoginRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
 
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 func respondWithError(w http.ResponseWriter, statusCode int, message string) {
@@ -61,13 +177,26 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := h.credentials.Validate(req.Login, req.Password); err != nil {
+		var fields validator.FieldErrors
+		if errors.As(err, &fields) {
+			respondWithJSON(w, http.StatusUnprocessableEntity, ValidationErrorResponse{
+				Error:  "Validation failed",
+				Fields: fields,
+			})
+			return
+		}
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
 	_, err := h.repo.CreateUser(req.Login, req.Password)
 	if err != nil {
-		status := http.StatusInternalServerError
 		if err == repository.ErrUserExists {
-			status = http.StatusConflict
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
 		}
-		respondWithError(w, status, err.Error())
+		respondWithError(w, http.StatusInternalServerError, "Failed to register user")
 		return
 	}
 
@@ -91,46 +220,256 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := auth.GenerateToken(user.Login)
+	h.issueTokens(w, user)
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token pair.
+// The presented refresh token is consumed.
+func (h *Handler) Refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+
+	user, err := h.repo.UseRefreshToken(auth.HashRefreshToken(req.RefreshToken))
+	if err != nil {
+		if err == repository.ErrInvalidRefreshToken {
+			respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to refresh token")
+		return
+	}
+
+	h.issueTokens(w, user)
+}
+
+// Logout revokes the access token of the request and, if given, a refresh
+// token of the same user.
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req LogoutRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request format")
+			return
+		}
+	}
+
+	if err := h.repo.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
+	if req.RefreshToken != "" {
+		if err := h.repo.RevokeRefreshToken(user.ID, auth.HashRefreshToken(req.RefreshToken)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to revoke token")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) issueTokens(w http.ResponseWriter, user *repository.User) {
+	token, err := h.auth.GenerateToken(user.Login)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	refreshToken, hash, expiresAt, err := h.auth.GenerateRefreshToken()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to generate token")
 		return
 	}
+	if err := h.repo.SaveRefreshToken(user.ID, hash, expiresAt); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, LoginResponse{Token: token})
+	respondWithJSON(w, http.StatusOK, LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(h.auth.TTL().Seconds()),
+	})
 }
+
 func (h *Handler) Authenticate(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			respondWithError(w, http.StatusUnauthorized, "Missing token")
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			respondUnauthorized(w, "", "", "Missing token")
 			return
 		}
 
-		_, err := auth.ValidateToken(tokenString)
+		tokenString, ok := bearerToken(header)
+		if !ok {
+			// A Bearer scheme without a token carries no credentials.
+			if scheme, _, _ := strings.Cut(strings.TrimSpace(header), " "); strings.EqualFold(scheme, "Bearer") {
+				respondUnauthorized(w, "", "", "Missing token")
+				return
+			}
+			respondUnauthorized(w, "", "", "Unsupported authorization scheme")
+			return
+		}
+
+		claims, err := h.auth.ValidateToken(tokenString)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrTokenExpired):
+				respondUnauthorized(w, "invalid_token", "The access token expired", "Token expired")
+			case errors.Is(err, auth.ErrTokenMalformed):
+				respondUnauthorized(w, "invalid_token", "The access token is malformed", "Malformed token")
+			default:
+				respondUnauthorized(w, "invalid_token", "The access token is invalid", "Invalid token")
+			}
+			return
+		}
+
+		revoked, err := h.repo.IsTokenRevoked(claims.ID)
 		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, "Invalid token")
+			respondWithError(w, http.StatusInternalServerError, "Failed to authenticate")
+			return
+		}
+		if revoked {
+			respondUnauthorized(w, "invalid_token", "The access token has been revoked", "Token revoked")
 			return
 		}
 
+		// The token may outlive its user, so resolve it on every request.
+		user, err := h.repo.GetUserByLogin(claims.Login)
+		if err != nil {
+			if err == repository.ErrUserNotFound {
+				respondUnauthorized(w, "invalid_token", "The access token is invalid", "Invalid token")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Failed to authenticate")
+			return
+		}
+
+		ctx := WithUser(r.Context(), &repository.User{ID: user.ID, Login: user.Login})
+		ctx = context.WithValue(ctx, claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// RequireAdmin lets only operators through to next. It must run behind
+// Authenticate.
+func (h *Handler) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if !h.admins[user.Login] {
+			respondWithError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
 		next.ServeHTTP(w, r)
 	}
 }
 
+// authRealm is reported in WWW-Authenticate challenges.
+const authRealm = "calc-service"
+
+// bearerToken extracts the token from an Authorization header (RFC 6750).
+// ok is false for other schemes and for a Bearer scheme without a token.
+// For backward compatibility with clients written before the Bearer scheme
+// was supported, which sent the token alone, a header without a scheme is
+// taken as a bare token.
+func bearerToken(header string) (string, bool) {
+	header = strings.TrimSpace(header)
+	scheme, token, found := strings.Cut(header, " ")
+	if !found {
+		if strings.EqualFold(header, "Bearer") {
+			return "", false
+		}
+		return header, true
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// respondUnauthorized answers 401 with a Bearer challenge. errorCode and
+// description are omitted when the request carried no Bearer credentials,
+// as RFC 6750 requires.
+func respondUnauthorized(w http.ResponseWriter, errorCode, description, message string) {
+	challenge := fmt.Sprintf("Bearer realm=%q", authRealm)
+	if errorCode != "" {
+		challenge += fmt.Sprintf(", error=%q, error_description=%q", errorCode, description)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondWithError(w, http.StatusUnauthorized, message)
+}
+
 func (h *Handler) Calculate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
 	var req CalculateRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCalculateBody)).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
 		respondWithError(w, http.StatusUnprocessableEntity, "Invalid request format")
 		return
 	}
 
-	result, err := h.service.Calculate(req.Expression)
+	mode, err := calculator.ParseMode(req.Mode)
 	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Unknown mode, expected float, decimal or complex")
+		return
+	}
+
+	id, err := h.service.Submit(user.ID, req.Expression, mode)
+	if err != nil {
+		var exprErr *calculator.Error
+		if errors.As(err, &exprErr) {
+			respondWithJSON(w, http.StatusUnprocessableEntity, ExpressionErrorResponse{
+				Error:    service.ErrInvalidExpression.Error(),
+				Message:  exprErr.Message,
+				Offset:   exprErr.Offset,
+				Expected: exprErr.Expected,
+				Found:    exprErr.Found,
+				Snippet:  exprErr.Snippet(),
+			})
+			return
+		}
 		status := http.StatusInternalServerError
 		if err == service.ErrInvalidExpression {
 			status = http.StatusUnprocessableEntity
@@ -139,5 +478,263 @@ func (h *Handler) Calculate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, CalculateResponse{Result: result})
+	respondWithJSON(w, http.StatusCreated, CalculateResponse{ID: id})
+}
+
+func (h *Handler) ListExpressions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	tasks, err := h.repo.GetUserTasks(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to get expressions")
+		return
+	}
+
+	expressions := make([]Expression, 0, len(tasks))
+	for _, task := range tasks {
+		expressions = append(expressions, h.newExpression(task))
+	}
+
+	respondWithJSON(w, http.StatusOK, ExpressionsResponse{Expressions: expressions})
+}
+
+func (h *Handler) GetExpression(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	task, err := h.repo.GetTaskByID(r.PathValue("id"))
+	if err != nil {
+		if err == repository.ErrTaskNotFound {
+			respondWithError(w, http.StatusNotFound, "Expression not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to get expression")
+		return
+	}
+
+	// Operations of an expression and other users' expressions are not
+	// visible through this endpoint; report them as missing.
+	if task.ExpressionID != "" || task.UserID != user.ID {
+		respondWithError(w, http.StatusNotFound, "Expression not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, ExpressionResponse{Expression: h.newExpression(*task)})
+}
+
+// ListWorkers reports the agents known to the orchestrator. An agent is
+// "alive" if it was heard from within the worker timeout, "dead" otherwise.
+// Only operators may see them.
+func (h *Handler) ListWorkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	workers, err := h.repo.GetWorkers()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to get workers")
+		return
+	}
+
+	now := time.Now()
+	resp := WorkersResponse{Workers: make([]Worker, 0, len(workers))}
+	for _, wk := range workers {
+		status := "alive"
+		if now.Sub(wk.LastSeen) > h.workerTimeout {
+			status = "dead"
+		}
+		tasks := wk.Tasks
+		if tasks == nil {
+			tasks = []string{}
+		}
+		resp.Workers = append(resp.Workers, Worker{
+			ID:           wk.ID,
+			Hostname:     wk.Hostname,
+			Capacity:     wk.Capacity,
+			Status:       status,
+			RegisteredAt: wk.RegisteredAt,
+			LastSeen:     wk.LastSeen,
+			Tasks:        tasks,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// ListVariables reports the variables stored by the user.
+func (h *Handler) ListVariables(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	variables, err := h.repo.GetVariables(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to get variables")
+		return
+	}
+
+	resp := VariablesResponse{Variables: make([]Variable, 0, len(variables))}
+	for _, v := range variables {
+		resp.Variables = append(resp.Variables, newVariable(v))
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// Variable reads (GET), sets (PUT) or deletes (DELETE) a variable of the
+// user.
+func (h *Handler) Variable(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		v, err := h.repo.GetVariable(user.ID, name)
+		if err != nil {
+			if err == repository.ErrVariableNotFound {
+				respondWithError(w, http.StatusNotFound, "Variable not found")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Failed to get variable")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, VariableResponse{Variable: newVariable(*v)})
+
+	case http.MethodPut:
+		var req SetVariableRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Value) == 0 {
+			respondWithError(w, http.StatusUnprocessableEntity, "Invalid request format")
+			return
+		}
+		value := string(req.Value)
+		if req.Value[0] == '"' {
+			if err := json.Unmarshal(req.Value, &value); err != nil {
+				respondWithError(w, http.StatusUnprocessableEntity, "Invalid request format")
+				return
+			}
+		}
+
+		v, err := h.service.SetVariable(user.ID, name, value)
+		if err != nil {
+			if err == service.ErrInvalidVariable || err == service.ErrInvalidValue {
+				respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Failed to set variable")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, VariableResponse{Variable: newVariable(*v)})
+
+	case http.MethodDelete:
+		if err := h.repo.DeleteVariable(user.ID, name); err != nil {
+			if err == repository.ErrVariableNotFound {
+				respondWithError(w, http.StatusNotFound, "Variable not found")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Failed to delete variable")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func newVariable(v repository.Variable) Variable {
+	variable := Variable{Name: v.Name, Value: v.Value, UpdatedAt: v.UpdatedAt}
+	if f, err := strconv.ParseFloat(v.Value, 64); err == nil && strconv.FormatFloat(f, 'g', -1, 64) == v.Value {
+		variable.Value = f
+	}
+	return variable
+}
+
+func (h *Handler) newExpression(task repository.Task) Expression {
+	expr := Expression{
+		ID:         task.ID,
+		Expression: task.Expression,
+		Mode:       task.Mode,
+		Status:     task.Status,
+		Error:      task.Error,
+		CreatedAt:  task.CreatedAt,
+	}
+	switch task.Status {
+	case repository.StatusCompleted:
+		expr.Result = h.formatResult(task)
+		fallthrough
+	case repository.StatusFailed:
+		completedAt := task.CompletedAt
+		expr.CompletedAt = &completedAt
+	}
+	return expr
+}
+
+func (h *Handler) formatResult(task repository.Task) any {
+	switch calculator.Mode(task.Mode) {
+	case calculator.ModeDecimal:
+		if result, err := calculator.FormatDecimal(task.Result, h.decimalPrecision); err == nil {
+			return result
+		}
+		return task.Result
+	case calculator.ModeComplex:
+		// Complex results are strings such as "5+5i", also when they are real.
+		return task.Result
+	}
+	result, err := calculator.ParseValue(task.Result)
+	if err != nil {
+		return task.Result
+	}
+	return result
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	claimsContextKey
+)
+
+// WithUser returns a copy of ctx carrying the authenticated user.
+func WithUser(ctx context.Context, user *repository.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns the user stored by Authenticate.
+func UserFromContext(ctx context.Context) (*repository.User, bool) {
+	user, ok := ctx.Value(userContextKey).(*repository.User)
+	return user, ok && user != nil
+}
+
+func claimsFromContext(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*auth.Claims)
+	return claims, ok && claims != nil
 }
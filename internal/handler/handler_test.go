@@ -0,0 +1,570 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zubrodin/calc-service/internal/auth"
+	"github.com/zubrodin/calc-service/internal/config"
+	"github.com/zubrodin/calc-service/internal/repository"
+	"github.com/zubrodin/calc-service/internal/service"
+	"github.com/zubrodin/calc-service/pkg/calculator"
+	"github.com/zubrodin/calc-service/pkg/validator"
+)
+
+type testServer struct {
+	mux  *http.ServeMux
+	repo *repository.SQLiteRepository
+	auth *auth.Auth
+}
+
+// newTestServer serves the routes of the API the way the app does, with
+// "admin" as the only operator.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	repo, err := repository.NewSQLiteRepository(filepath.Join(t.TempDir(), "calc.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+
+	a, err := auth.New(&config.Config{
+		JWTKeys:        map[string]string{"k1": "secret"},
+		JWTActiveKeyID: "k1",
+		JWTTTL:         time.Minute,
+		RefreshTTL:     time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("auth.New() error = %v", err)
+	}
+
+	credentials, err := validator.NewCredentials(validator.CredentialRules{LoginMinLength: 3, PasswordMinLength: 8})
+	if err != nil {
+		t.Fatalf("NewCredentials() error = %v", err)
+	}
+
+	calc := calculator.New()
+	svc := service.New(calc, validator.New(calc), repo)
+	h := New(svc, repo, a, credentials, time.Minute, 5, []string{"admin"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/register", h.Register)
+	mux.HandleFunc("/api/v1/login", h.Login)
+	mux.HandleFunc("/api/v1/refresh", h.Refresh)
+	mux.HandleFunc("/api/v1/logout", h.Authenticate(h.Logout))
+	mux.HandleFunc("/api/v1/calculate", h.Authenticate(h.Calculate))
+	mux.HandleFunc("/api/v1/expressions", h.Authenticate(h.ListExpressions))
+	mux.HandleFunc("/api/v1/expressions/{id}", h.Authenticate(h.GetExpression))
+	mux.HandleFunc("/api/v1/workers", h.Authenticate(h.RequireAdmin(h.ListWorkers)))
+	mux.HandleFunc("/api/v1/variables", h.Authenticate(h.ListVariables))
+	mux.HandleFunc("/api/v1/variables/{name}", h.Authenticate(h.Variable))
+
+	for _, login := range []string{"user1", "user2", "admin"} {
+		if _, err := repo.CreateUser(login, "password123"); err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+	}
+	return &testServer{mux: mux, repo: repo, auth: a}
+}
+
+func (s *testServer) token(t *testing.T, login string) string {
+	t.Helper()
+	token, err := s.auth.GenerateToken(login)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	return token
+}
+
+func (s *testServer) do(method, path, authorization, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// calculate submits expr and returns the ID of the new expression.
+func (s *testServer) calculate(t *testing.T, authorization, expr string) string {
+	t.Helper()
+	rec := s.do(http.MethodPost, "/api/v1/calculate", authorization, `{"expression":"`+expr+`"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("calculate status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	var created CalculateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode calculate response: %v", err)
+	}
+	return created.ID
+}
+
+func errorMessage(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	return resp["error"]
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header    string
+		wantToken string
+		wantOK    bool
+	}{
+		{"Bearer abc", "abc", true},
+		{"bearer abc", "abc", true},
+		{"BEARER  abc ", "abc", true},
+		{"abc", "abc", true},
+		{"Basic abc", "", false},
+		{"Bearer", "", false},
+		{"bearer", "", false},
+		{"Bearer  ", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			token, ok := bearerToken(tt.header)
+			if token != tt.wantToken || ok != tt.wantOK {
+				t.Errorf("bearerToken(%q) = %q, %v, want %q, %v", tt.header, token, ok, tt.wantToken, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newTestServer(t)
+	token := s.token(t, "user1")
+
+	revoked := s.token(t, "user1")
+	if rec := s.do(http.MethodPost, "/api/v1/logout", "Bearer "+revoked, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	tests := []struct {
+		name          string
+		header        string
+		wantStatus    int
+		wantError     string
+		wantChallenge string
+	}{
+		{"valid", "Bearer " + token, http.StatusNotFound, "Expression not found", ""},
+		{"lower case scheme", "bearer " + token, http.StatusNotFound, "Expression not found", ""},
+		{"bare token", token, http.StatusNotFound, "Expression not found", ""},
+		{"missing", "", http.StatusUnauthorized, "Missing token", `Bearer realm="calc-service"`},
+		{"scheme without token", "Bearer", http.StatusUnauthorized, "Missing token", `Bearer realm="calc-service"`},
+		{"other scheme", "Basic dXNlcjE6cGFzcw==", http.StatusUnauthorized, "Unsupported authorization scheme",
+			`Bearer realm="calc-service"`},
+		{"malformed", "Bearer abc", http.StatusUnauthorized, "Malformed token", `error="invalid_token"`},
+		{"wrong signature", "Bearer " + token[:len(token)-2] + "xx", http.StatusUnauthorized, "Invalid token",
+			`error="invalid_token"`},
+		{"revoked", "Bearer " + revoked, http.StatusUnauthorized, "Token revoked", `error="invalid_token"`},
+		{"unknown user", "Bearer " + s.token(t, "nobody"), http.StatusUnauthorized, "Invalid token",
+			`error="invalid_token"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(http.MethodGet, "/api/v1/expressions/missing", tt.header, "")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); !strings.Contains(got, tt.wantChallenge) {
+				t.Errorf("WWW-Authenticate = %q, want it to contain %q", got, tt.wantChallenge)
+			}
+			if got := errorMessage(t, rec); got != tt.wantError {
+				t.Errorf("error = %q, want %q", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func (s *testServer) login(t *testing.T, login string) LoginResponse {
+	t.Helper()
+	rec := s.do(http.MethodPost, "/api/v1/login", "", `{"login":"`+login+`","password":"password123"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var resp LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode login response: %v", err)
+	}
+	return resp
+}
+
+func TestRefresh(t *testing.T) {
+	s := newTestServer(t)
+	session := s.login(t, "user1")
+	if session.Token == "" || session.RefreshToken == "" || session.ExpiresIn != 60 {
+		t.Fatalf("login response = %+v, want both tokens expiring in 60s", session)
+	}
+
+	rec := s.do(http.MethodPost, "/api/v1/refresh", "", `{"refresh_token":"`+session.RefreshToken+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var refreshed LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&refreshed); err != nil {
+		t.Fatalf("failed to decode refresh response: %v", err)
+	}
+	if refreshed.RefreshToken == session.RefreshToken {
+		t.Error("refresh returned the same refresh token")
+	}
+	if rec := s.do(http.MethodGet, "/api/v1/expressions", "Bearer "+refreshed.Token, ""); rec.Code != http.StatusOK {
+		t.Errorf("request with the refreshed token status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"used token", `{"refresh_token":"` + session.RefreshToken + `"}`, http.StatusUnauthorized},
+		{"unknown token", `{"refresh_token":"abc"}`, http.StatusUnauthorized},
+		{"no token", `{}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := s.do(http.MethodPost, "/api/v1/refresh", "", tt.body); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s := newTestServer(t)
+
+	// A refresh token of another user is left alone.
+	other := s.login(t, "user2")
+	rec := s.do(http.MethodPost, "/api/v1/logout", "Bearer "+s.login(t, "user1").Token, `{"refresh_token":"`+other.RefreshToken+`"}`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := s.do(http.MethodPost, "/api/v1/refresh", "", `{"refresh_token":"`+other.RefreshToken+`"}`); rec.Code != http.StatusOK {
+		t.Errorf("refresh of another user's token status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	session := s.login(t, "user1")
+	rec = s.do(http.MethodPost, "/api/v1/logout", "Bearer "+session.Token, `{"refresh_token":"`+session.RefreshToken+`"}`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := s.do(http.MethodPost, "/api/v1/refresh", "", `{"refresh_token":"`+session.RefreshToken+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := s.do(http.MethodGet, "/api/v1/expressions/missing", "Bearer "+session.Token, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("request after logout status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestGetExpression(t *testing.T) {
+	s := newTestServer(t)
+	owner := "Bearer " + s.token(t, "user1")
+
+	id := s.calculate(t, owner, "2+3*4")
+	op, err := s.repo.GetPendingTask("worker-1", time.Minute)
+	if err != nil || op == nil {
+		t.Fatalf("GetPendingTask() = %v, %v, want an operation", op, err)
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		id            string
+		wantStatus    int
+	}{
+		{"own expression", http.MethodGet, owner, id, http.StatusOK},
+		{"unknown", http.MethodGet, owner, "missing", http.StatusNotFound},
+		{"operation of the expression", http.MethodGet, owner, op.ID, http.StatusNotFound},
+		{"other user", http.MethodGet, "Bearer " + s.token(t, "user2"), id, http.StatusNotFound},
+		{"wrong method", http.MethodPost, owner, id, http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(tt.method, "/api/v1/expressions/"+tt.id, tt.authorization, "")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var resp ExpressionResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode expression: %v", err)
+			}
+			if resp.Expression.ID != id || resp.Expression.Status != repository.StatusPending || resp.Expression.Result != nil {
+				t.Errorf("expression = %+v, want pending %s without a result", resp.Expression, id)
+			}
+		})
+	}
+}
+
+func TestCalculateInvalidExpression(t *testing.T) {
+	s := newTestServer(t)
+	rec := s.do(http.MethodPost, "/api/v1/calculate", "Bearer "+s.token(t, "user1"), `{"expression":"2+*3"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	var resp ExpressionErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	if resp.Offset != 2 || resp.Found != `"*"` || resp.Snippet != "2+*3\n  ^" {
+		t.Errorf("error = %+v, want it at offset 2 on *", resp)
+	}
+}
+
+func TestCalculateLimits(t *testing.T) {
+	s := newTestServer(t)
+	token := "Bearer " + s.token(t, "user1")
+
+	nested := strings.Repeat("(", 1000) + "1" + strings.Repeat(")", 1000)
+	if rec := s.do(http.MethodPost, "/api/v1/calculate", token, `{"expression":"`+nested+`"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("nested expression status = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+
+	long := strings.Repeat("1+", maxCalculateBody/2) + "1"
+	if rec := s.do(http.MethodPost, "/api/v1/calculate", token, `{"expression":"`+long+`"}`); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("long expression status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if op, err := s.repo.GetPendingTask("worker-1", time.Minute); err != nil || op != nil {
+		t.Errorf("GetPendingTask() = %+v, %v, want no operations", op, err)
+	}
+}
+
+func TestCalculateDecimalMode(t *testing.T) {
+	s := newTestServer(t)
+	token := "Bearer " + s.token(t, "user1")
+
+	rec := s.do(http.MethodPost, "/api/v1/calculate", token, `{"expression":"1/3","mode":"decimal"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	var created CalculateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode calculate response: %v", err)
+	}
+	op, err := s.repo.GetPendingTask("worker-1", time.Minute)
+	if err != nil || op == nil {
+		t.Fatalf("GetPendingTask() = %v, %v, want an operation", op, err)
+	}
+	if err := s.repo.SaveResult(op.ID, "worker-1", "1/3"); err != nil {
+		t.Fatalf("SaveResult() error = %v", err)
+	}
+
+	rec = s.do(http.MethodGet, "/api/v1/expressions/"+created.ID, token, "")
+	var resp ExpressionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode expression: %v", err)
+	}
+	// Decimal results are strings rounded to the configured precision.
+	if resp.Expression.Mode != "decimal" || resp.Expression.Result != "0.33333" {
+		t.Errorf("expression = %+v, want decimal result 0.33333", resp.Expression)
+	}
+
+	rec = s.do(http.MethodPost, "/api/v1/calculate", token, `{"expression":"1/3","mode":"exact"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status for an unknown mode = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestCalculateComplexMode(t *testing.T) {
+	s := newTestServer(t)
+	token := "Bearer " + s.token(t, "user1")
+
+	// Complex results are strings, also when they are real.
+	for expr, want := range map[string]string{"2i": "2i", "7": "7"} {
+		rec := s.do(http.MethodPost, "/api/v1/calculate", token, `{"expression":"`+expr+`","mode":"complex"}`)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusCreated)
+		}
+		var created CalculateResponse
+		if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+			t.Fatalf("failed to decode calculate response: %v", err)
+		}
+
+		rec = s.do(http.MethodGet, "/api/v1/expressions/"+created.ID, token, "")
+		var resp ExpressionResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode expression: %v", err)
+		}
+		if resp.Expression.Mode != "complex" || resp.Expression.Result != want {
+			t.Errorf("expression %s = %+v, want result %q", expr, resp.Expression, want)
+		}
+	}
+}
+
+func TestListExpressions(t *testing.T) {
+	s := newTestServer(t)
+	token := "Bearer " + s.token(t, "user1")
+
+	pending := s.calculate(t, token, "2+3")
+	completed := s.calculate(t, token, "7")
+	s.calculate(t, "Bearer "+s.token(t, "user2"), "1+1")
+
+	rec := s.do(http.MethodGet, "/api/v1/expressions", token, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var resp ExpressionsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode expressions: %v", err)
+	}
+	if len(resp.Expressions) != 2 {
+		t.Fatalf("expressions = %+v, want 2", resp.Expressions)
+	}
+
+	got := map[string]Expression{}
+	for _, e := range resp.Expressions {
+		got[e.ID] = e
+	}
+	if e := got[pending]; e.Status != repository.StatusPending || e.Result != nil || e.CompletedAt != nil {
+		t.Errorf("pending expression = %+v, want no result", e)
+	}
+	if e := got[completed]; e.Status != repository.StatusCompleted || e.Result != 7.0 || e.CompletedAt == nil {
+		t.Errorf("completed expression = %+v, want result 7", e)
+	}
+}
+
+func TestListWorkers(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.repo.RegisterWorker(repository.Worker{ID: "worker-1", Capacity: 2}); err != nil {
+		t.Fatalf("RegisterWorker() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		login      string
+		wantStatus int
+	}{
+		{"operator", "admin", http.StatusOK},
+		{"user", "user1", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(http.MethodGet, "/api/v1/workers", "Bearer "+s.token(t, tt.login), "")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var resp WorkersResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode workers: %v", err)
+			}
+			if len(resp.Workers) != 1 || resp.Workers[0].ID != "worker-1" || resp.Workers[0].Status != "alive" {
+				t.Errorf("workers = %+v, want worker-1 alive", resp.Workers)
+			}
+		})
+	}
+
+	if rec := s.do(http.MethodGet, "/api/v1/workers", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("status without a token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	s := newTestServer(t)
+	token := "Bearer " + s.token(t, "user1")
+
+	rec := s.do(http.MethodPut, "/api/v1/variables/x", token, `{"value":2.5}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var set VariableResponse
+	if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+		t.Fatalf("failed to decode variable: %v", err)
+	}
+	if set.Variable.Name != "x" || set.Variable.Value != 2.5 {
+		t.Errorf("variable = %+v, want x = 2.5", set.Variable)
+	}
+
+	// Values that are not exact numbers are strings.
+	if rec := s.do(http.MethodPut, "/api/v1/variables/y", token, `{"value":"1/3"}`); rec.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	rec = s.do(http.MethodGet, "/api/v1/variables/y", token, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got VariableResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode variable: %v", err)
+	}
+	if got.Variable.Value != "1/3" {
+		t.Errorf("variable = %+v, want y = 1/3", got.Variable)
+	}
+
+	rec = s.do(http.MethodGet, "/api/v1/variables", token, "")
+	var list VariablesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode variables: %v", err)
+	}
+	if len(list.Variables) != 2 || list.Variables[0].Name != "x" || list.Variables[1].Name != "y" {
+		t.Errorf("variables = %+v, want x and y", list.Variables)
+	}
+	if rec := s.do(http.MethodGet, "/api/v1/variables/x", "Bearer "+s.token(t, "user2"), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET status for another user = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	for _, tt := range []struct{ name, path, body string }{
+		{"constant", "/api/v1/variables/pi", `{"value":3}`},
+		{"function", "/api/v1/variables/sqrt", `{"value":3}`},
+		{"invalid name", "/api/v1/variables/1x", `{"value":3}`},
+		{"missing value", "/api/v1/variables/y", `{}`},
+		{"invalid value", "/api/v1/variables/y", `{"value":"abc"}`},
+		{"NaN", "/api/v1/variables/y", `{"value":"NaN"}`},
+		{"infinity", "/api/v1/variables/y", `{"value":"Inf"}`},
+		{"hexadecimal", "/api/v1/variables/y", `{"value":"0x10"}`},
+		{"underscores", "/api/v1/variables/y", `{"value":"1_000"}`},
+		{"overflow", "/api/v1/variables/y", `{"value":1e400}`},
+		{"huge exponent", "/api/v1/variables/y", `{"value":"1e-9999999"}`},
+	} {
+		if rec := s.do(http.MethodPut, tt.path, token, tt.body); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("PUT %s status = %d, want %d", tt.name, rec.Code, http.StatusUnprocessableEntity)
+		}
+	}
+
+	if rec := s.do(http.MethodDelete, "/api/v1/variables/x", token, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := s.do(http.MethodDelete, "/api/v1/variables/x", token, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"valid", `{"login":"user3","password":"password123"}`, http.StatusOK},
+		{"existing login", `{"login":"user1","password":"password123"}`, http.StatusConflict},
+		{"invalid fields", `{"login":"u","password":"short"}`, http.StatusUnprocessableEntity},
+		{"invalid JSON", `{"login":`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(http.MethodPost, "/api/v1/register", "", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
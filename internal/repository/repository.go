@@ -3,6 +3,8 @@ package repository
 import (
 	"errors"
 	"time"
+
+	"github.com/zubrodin/calc-service/pkg/calculator"
 )
 
 type User struct {
@@ -11,28 +13,87 @@ type User struct {
 	Password string
 }
 
+// Task is either a user expression or one of the operations it was
+// decomposed into. Operations reference their expression by ExpressionID;
+// Arity tells whether an operation takes Arg1 only or Arg2 as well. Mode is
+// the calculator.Mode of the expression, in which Result is formatted.
 type Task struct {
-	ID          string
-	UserID      int
-	Expression  string
-	Arg1        string
-	Arg2        string
-	Operation   string
-	Result      float64
-	Status      string
-	CreatedAt   time.Time
-	StartedAt   time.Time
-	CompletedAt time.Time
+	ID           string
+	UserID       int
+	ExpressionID string
+	Expression   string
+	Arg1         string
+	Arg2         string
+	Arity        int
+	Operation    string
+	Mode         string
+	Result       string
+	Status       string
+	Error        string
+	Attempts     int
+	WorkerID     string
+	CreatedAt    time.Time
+	StartedAt    time.Time
+	CompletedAt  time.Time
+}
+
+// Worker is an agent known to the orchestrator. Tasks lists the operations
+// it currently holds.
+type Worker struct {
+	ID           string
+	Hostname     string
+	Capacity     int
+	RegisteredAt time.Time
+	LastSeen     time.Time
+	Tasks        []string
+}
+
+// Variable is a value a user has stored under a name for use in later
+// expressions. Value is formatted like results of calculator.Apply in any
+// mode: "0.1", "1/3" or "1+2i".
+type Variable struct {
+	Name      string
+	Value     string
+	UpdatedAt time.Time
 }
 
+// Task statuses. Operations start as StatusWaiting until the results of the
+// operations they depend on arrive; expressions are StatusPending until
+// their last operation completes or any of them fails.
+const (
+	StatusWaiting    = "waiting"
+	StatusPending    = "pending"
+	StatusInProgress = "in_progress"
+	StatusCompleted  = "completed"
+	StatusFailed     = "failed"
+	StatusCanceled   = "canceled"
+)
+
 type Repository interface {
 	CreateUser(login, password string) (int64, error)
 	Authenticate(login, password string) (*User, error)
-	CreateTask(userID int, expr string) (string, error)
-	GetPendingTask() (*Task, error)
-	SaveResult(id string, result float64) error
+	GetUserByLogin(login string) (*User, error)
+	SaveRefreshToken(userID int, tokenHash string, expiresAt time.Time) error
+	UseRefreshToken(tokenHash string) (*User, error)
+	RevokeRefreshToken(userID int, tokenHash string) error
+	RevokeToken(tokenID string, expiresAt time.Time) error
+	IsTokenRevoked(tokenID string) (bool, error)
+	CreateTask(userID int, expr string, mode calculator.Mode, plan *calculator.Plan) (string, error)
+	GetPendingTask(workerID string, lease time.Duration) (*Task, error)
+	SaveResult(id, workerID, result string) error
+	SaveError(id, workerID, message string) error
+	ReleaseExpiredLeases(maxAttempts int) (released, failed int, err error)
+	ReleaseLeases() (int, error)
+	RegisterWorker(worker Worker) error
+	TouchWorker(id string) error
+	GetWorkers() ([]Worker, error)
 	GetUserTasks(userID int) ([]Task, error)
 	GetTaskByID(id string) (*Task, error)
+	GetVariables(userID int) ([]Variable, error)
+	GetVariable(userID int, name string) (*Variable, error)
+	SetVariable(userID int, name string, value string) (*Variable, error)
+	DeleteVariable(userID int, name string) error
+	Close() error
 }
 
 var (
@@ -40,4 +101,13 @@ var (
 	ErrUserNotFound    = errors.New("user not found")
 	ErrInvalidPassword = errors.New("invalid password")
 	ErrTaskNotFound    = errors.New("task not found")
+	ErrWorkerNotFound  = errors.New("worker not found")
+
+	ErrVariableNotFound = errors.New("variable not found")
+
+	ErrTaskNotInProgress = errors.New("task is not in progress")
+	ErrTaskNotLeased     = errors.New("task is leased to another worker")
+	ErrTaskCanceled      = errors.New("task was canceled because its expression failed")
+
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
 )
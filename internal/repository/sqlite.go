@@ -2,10 +2,14 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"github.com/zubrodin/calc-service/internal/auth"
+	"github.com/zubrodin/calc-service/pkg/calculator"
 )
 
 type SQLiteRepository struct {
@@ -22,6 +26,10 @@ func NewSQLiteRepository(dbPath string) (*SQLiteRepository, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
+	// SQLite allows a single writer; serializing connections keeps task
+	// dispatch transactions from failing with "database is locked".
+	db.SetMaxOpenConns(1)
+
 	if _, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -32,15 +40,68 @@ func NewSQLiteRepository(dbPath string) (*SQLiteRepository, error) {
 		CREATE TABLE IF NOT EXISTS tasks (
 			id TEXT PRIMARY KEY,
 			user_id INTEGER,
+			expression_id TEXT,
 			expression TEXT,
 			arg1 TEXT,
 			arg2 TEXT,
+			arity INTEGER NOT NULL DEFAULT 2,
 			operation TEXT,
+			mode TEXT NOT NULL DEFAULT 'float',
 			result REAL,
+			result_text TEXT,
 			status TEXT DEFAULT 'pending',
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			started_at DATETIME,
 			completed_at DATETIME,
+			lease_expires_at INTEGER,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			error TEXT,
+			worker_id TEXT,
+			result_id TEXT,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		
+		CREATE TABLE IF NOT EXISTS task_dependents (
+			task_id TEXT NOT NULL,
+			dependent_id TEXT NOT NULL,
+			slot INTEGER NOT NULL,
+			PRIMARY KEY(task_id, dependent_id, slot)
+		);
+		
+		CREATE TABLE IF NOT EXISTS task_assignments (
+			task_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			PRIMARY KEY(task_id, name)
+		);
+		
+		CREATE TABLE IF NOT EXISTS workers (
+			id TEXT PRIMARY KEY,
+			hostname TEXT,
+			capacity INTEGER NOT NULL DEFAULT 0,
+			registered_at INTEGER NOT NULL,
+			last_seen INTEGER NOT NULL
+		);
+		
+		CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			revoked INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		
+		CREATE TABLE IF NOT EXISTS revoked_tokens (
+			token_id TEXT PRIMARY KEY,
+			expires_at INTEGER NOT NULL
+		);
+		
+		CREATE TABLE IF NOT EXISTS variables (
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			value TEXT NOT NULL,
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY(user_id, name),
 			FOREIGN KEY(user_id) REFERENCES users(id)
 		);
 		
@@ -50,16 +111,93 @@ func NewSQLiteRepository(dbPath string) (*SQLiteRepository, error) {
 		return nil, fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	return &SQLiteRepository{db: db}, nil
 }
 
+// migrate brings databases created by older versions up to the current schema.
+func migrate(db *sql.DB) error {
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"tasks", "expression_id", "TEXT"},
+		{"tasks", "lease_expires_at", "INTEGER"},
+		{"tasks", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"tasks", "error", "TEXT"},
+		{"tasks", "worker_id", "TEXT"},
+		{"tasks", "arity", "INTEGER NOT NULL DEFAULT 2"},
+		{"tasks", "result_id", "TEXT"},
+		{"tasks", "mode", "TEXT NOT NULL DEFAULT 'float'"},
+		{"tasks", "result_text", "TEXT"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(db, c.table, c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_tasks_expression ON tasks(expression_id);
+	`); err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+	return nil
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read %s schema: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return fmt.Errorf("failed to scan %s schema: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read %s schema: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) Close() error {
+	return r.db.Close()
+}
+
 func (r *SQLiteRepository) CreateUser(login, password string) (int64, error) {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return 0, fmt.Errorf("failed to hash password: %w", err)
+	}
+
 	res, err := r.db.Exec(
 		"INSERT INTO users (login, password) VALUES (?, ?)",
-		login, password,
+		login, hash,
 	)
 	if err != nil {
-		return 0, ErrUserExists
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return 0, ErrUserExists
+		}
+		return 0, fmt.Errorf("failed to create user: %w", err)
 	}
 	return res.LastInsertId()
 }
@@ -72,30 +210,285 @@ func (r *SQLiteRepository) Authenticate(login, password string) (*User, error) {
 	).Scan(&user.ID, &user.Login, &user.Password)
 
 	if err == sql.ErrNoRows {
+		auth.SimulatePasswordCheck(password)
 		return nil, ErrUserNotFound
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to query user: %w", err)
 	}
-	if user.Password != password {
+
+	ok, rehash := auth.VerifyPassword(user.Password, password)
+	if !ok {
 		return nil, ErrInvalidPassword
 	}
+
+	// Passwords of users created before hashing was introduced are stored
+	// in plain text; replace them now that the password is known.
+	if rehash {
+		hash, err := auth.HashPassword(password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %w", err)
+		}
+		if _, err := r.db.Exec(
+			"UPDATE users SET password = ? WHERE id = ?",
+			hash, user.ID,
+		); err != nil {
+			return nil, fmt.Errorf("failed to update password hash: %w", err)
+		}
+		user.Password = hash
+	}
 	return &user, nil
 }
 
-func (r *SQLiteRepository) CreateTask(userID int, expr string) (string, error) {
-	taskID := generateTaskID()
+func (r *SQLiteRepository) GetUserByLogin(login string) (*User, error) {
+	var user User
+	err := r.db.QueryRow(
+		"SELECT id, login, password FROM users WHERE login = ?",
+		login,
+	).Scan(&user.ID, &user.Login, &user.Password)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	return &user, nil
+}
+
+func (r *SQLiteRepository) SaveRefreshToken(userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := r.db.Exec(
+		"INSERT INTO refresh_tokens (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		tokenHash, userID, expiresAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save refresh token: %w", err)
+	}
+	return nil
+}
+
+// UseRefreshToken consumes a refresh token and returns its owner. Every
+// refresh token is single-use: presenting an already used one means it has
+// leaked, so all sessions of the user are revoked.
+func (r *SQLiteRepository) UseRefreshToken(tokenHash string) (*User, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		user      User
+		expiresAt int64
+		revoked   bool
+	)
+	err = tx.QueryRow(`
+		SELECT u.id, u.login, t.expires_at, t.revoked
+		FROM refresh_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ?
+	`, tokenHash).Scan(&user.ID, &user.Login, &expiresAt, &revoked)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query refresh token: %w", err)
+	}
+
+	if revoked {
+		if _, err := tx.Exec(
+			"UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?",
+			user.ID,
+		); err != nil {
+			return nil, fmt.Errorf("failed to revoke refresh tokens: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+	if time.Now().Unix() >= expiresAt {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE refresh_tokens SET revoked = 1 WHERE token_hash = ?",
+		tokenHash,
+	); err != nil {
+		return nil, fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &user, nil
+}
+
+// RevokeRefreshToken revokes a refresh token of the user. Tokens of other
+// users are left alone.
+func (r *SQLiteRepository) RevokeRefreshToken(userID int, tokenHash string) error {
 	_, err := r.db.Exec(
-		"INSERT INTO tasks (id, user_id, expression, status) VALUES (?, ?, ?, 'pending')",
-		taskID, userID, expr,
+		"UPDATE refresh_tokens SET revoked = 1 WHERE token_hash = ? AND user_id = ?",
+		tokenHash, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	return nil
+}
+
+// RevokeToken blacklists an access token until it expires on its own.
+// Entries for tokens that have already expired are dropped along the way.
+func (r *SQLiteRepository) RevokeToken(tokenID string, expiresAt time.Time) error {
+	if _, err := r.db.Exec(
+		"DELETE FROM revoked_tokens WHERE expires_at < ?",
+		time.Now().Unix(),
+	); err != nil {
+		return fmt.Errorf("failed to clean up revoked tokens: %w", err)
+	}
+
+	_, err := r.db.Exec(
+		"INSERT OR IGNORE INTO revoked_tokens (token_id, expires_at) VALUES (?, ?)",
+		tokenID, expiresAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) IsTokenRevoked(tokenID string) (bool, error) {
+	var revoked bool
+	err := r.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE token_id = ?)",
+		tokenID,
+	).Scan(&revoked)
+	if err != nil {
+		return false, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	return revoked, nil
+}
+
+// CreateTask stores an expression and the operations of its plan. Results
+// are kept as text in result_text, so that values computed in decimal mode
+// keep their precision; the result column only holds results of older
+// versions.
+func (r *SQLiteRepository) CreateTask(userID int, expr string, mode calculator.Mode, plan *calculator.Plan) (string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	taskID := generateTaskID()
+
+	// result_id names the operation whose result is the value of the
+	// expression; other operations without a parent only set variables.
+	var resultID sql.NullString
+	if plan.Result.IsRef() {
+		resultID = sql.NullString{String: operationID(taskID, plan.Result.Ref), Valid: true}
+	}
+	_, err = tx.Exec(
+		"INSERT INTO tasks (id, user_id, expression, mode, result_id, status) VALUES (?, ?, ?, ?, ?, 'pending')",
+		taskID, userID, expr, mode, resultID,
 	)
 	if err != nil {
 		return "", fmt.Errorf("failed to create task: %w", err)
 	}
+
+	// A number as the value of the expression is known at once. The
+	// expression still waits for the operations setting its variables,
+	// as in "x = 2*3; 7"; without any it is ready at once.
+	if !plan.Result.IsRef() {
+		if _, err := calculator.ParseComplex(plan.Result.Value); err != nil {
+			return "", fmt.Errorf("invalid result: %w", err)
+		}
+		_, err = tx.Exec("UPDATE tasks SET result_text = ? WHERE id = ?", plan.Result.Value, taskID)
+		if err != nil {
+			return "", fmt.Errorf("failed to save result: %w", err)
+		}
+	}
+	if len(plan.Operations) == 0 {
+		_, err = tx.Exec(`
+			UPDATE tasks 
+			SET status = 'completed', 
+			    completed_at = CURRENT_TIMESTAMP 
+			WHERE id = ?
+		`, taskID)
+		if err != nil {
+			return "", fmt.Errorf("failed to save result: %w", err)
+		}
+	}
+
+	// Variables assigned a number are set at once, the others when the
+	// operation computing their value completes.
+	for _, a := range plan.Assignments {
+		if a.Value.IsRef() {
+			continue
+		}
+		if err := setVariable(tx, userID, a.Name, a.Value.Value, time.Now()); err != nil {
+			return "", err
+		}
+	}
+
+	for i, op := range plan.Operations {
+		if len(op.Args) < 1 || len(op.Args) > 2 {
+			return "", fmt.Errorf("operation %s has %d arguments, only 1 or 2 can be stored", op.Operator, len(op.Args))
+		}
+		status := "pending"
+		args := make([]sql.NullString, 2)
+		for slot, arg := range op.Args {
+			if arg.IsRef() {
+				status = "waiting"
+			}
+			args[slot] = operandValue(arg)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO tasks (id, user_id, expression_id, arg1, arg2, arity, operation, mode, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, operationID(taskID, i), userID, taskID, args[0], args[1], len(op.Args), op.Operator, mode, status)
+		if err != nil {
+			return "", fmt.Errorf("failed to create operation: %w", err)
+		}
+
+		// The operation is a dependent of every operation whose result it
+		// takes as the first (slot 1) or second (slot 2) argument.
+		for slot, arg := range op.Args {
+			if !arg.IsRef() {
+				continue
+			}
+			_, err = tx.Exec(
+				"INSERT OR IGNORE INTO task_dependents (task_id, dependent_id, slot) VALUES (?, ?, ?)",
+				operationID(taskID, arg.Ref), operationID(taskID, i), slot+1,
+			)
+			if err != nil {
+				return "", fmt.Errorf("failed to create operation: %w", err)
+			}
+		}
+	}
+
+	for _, a := range plan.Assignments {
+		if !a.Value.IsRef() {
+			continue
+		}
+		_, err = tx.Exec(
+			"INSERT INTO task_assignments (task_id, name) VALUES (?, ?)",
+			operationID(taskID, a.Value.Ref), a.Name,
+		)
+		if err != nil {
+			return "", fmt.Errorf("failed to create assignment: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return taskID, nil
 }
 
-func (r *SQLiteRepository) GetPendingTask() (*Task, error) {
+// GetPendingTask leases the oldest ready operation to the worker for the
+// given duration. If no result arrives before the lease expires,
+// ReleaseExpiredLeases hands the operation out again.
+func (r *SQLiteRepository) GetPendingTask(workerID string, lease time.Duration) (*Task, error) {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return nil, fmt.Errorf("failed to begin transaction: %w", err)
@@ -103,15 +496,18 @@ func (r *SQLiteRepository) GetPendingTask() (*Task, error) {
 	defer tx.Rollback()
 
 	row := tx.QueryRow(`
-		SELECT id, user_id, expression, arg1, arg2, operation 
+		SELECT id, user_id, expression_id, arg1, arg2, arity, operation, mode 
 		FROM tasks 
-		WHERE status = 'pending' 
+		WHERE status = 'pending' AND expression_id IS NOT NULL
 		ORDER BY created_at ASC 
 		LIMIT 1
 	`)
 
-	var task Task
-	err = row.Scan(&task.ID, &task.UserID, &task.Expression, &task.Arg1, &task.Arg2, &task.Operation)
+	var (
+		task Task
+		arg2 sql.NullString
+	)
+	err = row.Scan(&task.ID, &task.UserID, &task.ExpressionID, &task.Arg1, &arg2, &task.Arity, &task.Operation, &task.Mode)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -122,9 +518,12 @@ func (r *SQLiteRepository) GetPendingTask() (*Task, error) {
 	_, err = tx.Exec(`
 		UPDATE tasks 
 		SET status = 'in_progress', 
-		    started_at = CURRENT_TIMESTAMP 
+		    started_at = CURRENT_TIMESTAMP,
+		    lease_expires_at = ?,
+		    attempts = attempts + 1,
+		    worker_id = ?
 		WHERE id = ?
-	`, task.ID)
+	`, time.Now().Add(lease).Unix(), workerID, task.ID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update task status: %w", err)
 	}
@@ -133,29 +532,460 @@ func (r *SQLiteRepository) GetPendingTask() (*Task, error) {
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
+	task.Arg2 = arg2.String
+	task.WorkerID = workerID
 	return &task, nil
 }
 
-func (r *SQLiteRepository) SaveResult(id string, result float64) error {
-	_, err := r.db.Exec(`
+// SaveResult completes an operation leased to workerID and passes its result
+// on: into the waiting operations depending on it, the variables it is assigned to
+// and, for the operation computing the value of the expression, to the
+// expression. The expression completes with the last of its operations.
+// Repeating a submission that was already accepted is a no-op.
+func (r *SQLiteRepository) SaveResult(id, workerID, result string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	sub, err := getSubmission(tx, id)
+	if err != nil {
+		return err
+	}
+	if sub.status == StatusCompleted && sub.workerID == workerID &&
+		sub.result.Valid && sub.result.String == result {
+		return nil
+	}
+	if err := sub.check(workerID); err != nil {
+		return err
+	}
+	expressionID := sub.expressionID
+
+	_, err = tx.Exec(`
 		UPDATE tasks 
 		SET status = 'completed', 
-		    result = ?,
+		    result_text = ?,
+		    lease_expires_at = NULL,
 		    completed_at = CURRENT_TIMESTAMP 
 		WHERE id = ?
 	`, result, id)
 	if err != nil {
 		return fmt.Errorf("failed to save result: %w", err)
 	}
+
+	if err := passResult(tx, id, result); err != nil {
+		return err
+	}
+	if err := assignResult(tx, sub.userID, id, result); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE tasks 
+		SET result_text = ?
+		WHERE id = ? AND status = 'pending' AND result_id = ?
+	`, result, expressionID.String, id)
+	if err != nil {
+		return fmt.Errorf("failed to save expression result: %w", err)
+	}
+
+	// The expression completes with its last operation, so that it does not
+	// report a result before all of its variables are set.
+	_, err = tx.Exec(`
+		UPDATE tasks 
+		SET status = 'completed', 
+		    completed_at = CURRENT_TIMESTAMP 
+		WHERE id = ? AND status = 'pending'
+		  AND NOT EXISTS (
+		      SELECT 1 FROM tasks WHERE expression_id = ? AND status != 'completed'
+		  )
+	`, expressionID.String, expressionID.String)
+	if err != nil {
+		return fmt.Errorf("failed to complete expression: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
 
+// SaveError fails an operation that an agent could not compute, e.g. because
+// of a division by zero. The whole expression fails with the same message.
+// Like SaveResult, it only accepts reports from the worker holding the lease.
+func (r *SQLiteRepository) SaveError(id, workerID, message string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	sub, err := getSubmission(tx, id)
+	if err != nil {
+		return err
+	}
+	if sub.status == StatusFailed && sub.workerID == workerID && sub.err.String == message {
+		return nil
+	}
+	if err := sub.check(workerID); err != nil {
+		return err
+	}
+
+	if err := failTask(tx, id, sub.expressionID.String, message); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// passResult stores the result of the operation id as an argument of its
+// dependents. Dependents that have all of their arguments become pending.
+func passResult(tx *sql.Tx, id, result string) error {
+	rows, err := tx.Query("SELECT dependent_id, slot FROM task_dependents WHERE task_id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to query dependents: %w", err)
+	}
+	type dependent struct {
+		id   string
+		slot int
+	}
+	var dependents []dependent
+	for rows.Next() {
+		var d dependent
+		if err := rows.Scan(&d.id, &d.slot); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan dependent: %w", err)
+		}
+		dependents = append(dependents, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query dependents: %w", err)
+	}
+
+	for _, d := range dependents {
+		arg := "arg1"
+		if d.slot == 2 {
+			arg = "arg2"
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE tasks SET %s = ? WHERE id = ?", arg), result, d.id)
+		if err != nil {
+			return fmt.Errorf("failed to pass result to dependent: %w", err)
+		}
+		_, err = tx.Exec(`
+			UPDATE tasks 
+			SET status = 'pending' 
+			WHERE id = ? AND status = 'waiting' 
+			  AND arg1 IS NOT NULL AND (arg2 IS NOT NULL OR arity < 2)
+		`, d.id)
+		if err != nil {
+			return fmt.Errorf("failed to update dependent status: %w", err)
+		}
+	}
+	return nil
+}
+
+// assignResult stores the result of the operation id in the variables it is
+// assigned to.
+func assignResult(tx *sql.Tx, userID int, id, result string) error {
+	rows, err := tx.Query("SELECT name FROM task_assignments WHERE task_id = ? ORDER BY name", id)
+	if err != nil {
+		return fmt.Errorf("failed to query assignments: %w", err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan assignment: %w", err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query assignments: %w", err)
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		if err := setVariable(tx, userID, name, result, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submission is the state of an operation an agent reports the outcome of.
+type submission struct {
+	userID           int
+	expressionID     sql.NullString
+	status, workerID string
+	result, err      sql.NullString
+}
+
+func getSubmission(tx *sql.Tx, id string) (*submission, error) {
+	var (
+		sub    submission
+		worker sql.NullString
+	)
+	err := tx.QueryRow(`
+		SELECT user_id, expression_id, status, worker_id, result_text, error
+		FROM tasks
+		WHERE id = ?
+	`, id).Scan(&sub.userID, &sub.expressionID, &sub.status, &worker, &sub.result, &sub.err)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrTaskNotFound
+		}
+		return nil, fmt.Errorf("failed to get task: %w", err)
+	}
+	// Expressions themselves are never handed out to agents.
+	if !sub.expressionID.Valid {
+		return nil, ErrTaskNotFound
+	}
+	sub.workerID = worker.String
+	return &sub, nil
+}
+
+// check reports whether workerID may submit the outcome of the operation.
+func (s *submission) check(workerID string) error {
+	if s.status == StatusCanceled {
+		return ErrTaskCanceled
+	}
+	if s.status != StatusInProgress {
+		return ErrTaskNotInProgress
+	}
+	if s.workerID != workerID {
+		return ErrTaskNotLeased
+	}
+	return nil
+}
+
+// ReleaseExpiredLeases returns operations whose lease has expired to the
+// queue. Operations that have already been attempted maxAttempts times are
+// failed together with their expression instead. Operations of expressions
+// that are no longer pending are left alone.
+func (r *SQLiteRepository) ReleaseExpiredLeases(maxAttempts int) (released, failed int, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT t.id, t.expression_id, t.attempts
+		FROM tasks t
+		JOIN tasks e ON e.id = t.expression_id
+		WHERE t.status = 'in_progress' AND t.lease_expires_at < ?
+		  AND e.status = 'pending'
+	`, time.Now().Unix())
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query expired leases: %w", err)
+	}
+
+	type expired struct {
+		id, expressionID string
+		attempts         int
+	}
+	var tasks []expired
+	for rows.Next() {
+		var t expired
+		if err := rows.Scan(&t.id, &t.expressionID, &t.attempts); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan task: %w", err)
+		}
+		tasks = append(tasks, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to query expired leases: %w", err)
+	}
+
+	for _, t := range tasks {
+		if t.attempts >= maxAttempts {
+			msg := fmt.Sprintf("no result after %d attempts", t.attempts)
+			if err := failTask(tx, t.id, t.expressionID, msg); err != nil {
+				return 0, 0, err
+			}
+			failed++
+			continue
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE tasks 
+			SET status = 'pending', 
+			    lease_expires_at = NULL 
+			WHERE id = ?
+		`, t.id); err != nil {
+			return 0, 0, fmt.Errorf("failed to release task: %w", err)
+		}
+		released++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return released, failed, nil
+}
+
+// ReleaseLeases returns every leased operation to the queue without
+// counting the interrupted attempt. It is used when the orchestrator stops
+// before agents have reported the results.
+func (r *SQLiteRepository) ReleaseLeases() (int, error) {
+	res, err := r.db.Exec(`
+		UPDATE tasks 
+		SET status = 'pending', 
+		    lease_expires_at = NULL,
+		    attempts = MAX(attempts - 1, 0)
+		WHERE status = 'in_progress' AND expression_id IS NOT NULL
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release leases: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to release leases: %w", err)
+	}
+	return int(n), nil
+}
+
+// failTask marks an operation and its expression as failed. The other
+// operations of the expression that have not completed are canceled,
+// including those leased to agents, whose results are then refused.
+func failTask(tx *sql.Tx, id, expressionID, message string) error {
+	if _, err := tx.Exec(`
+		UPDATE tasks 
+		SET status = 'failed', 
+		    error = ?,
+		    lease_expires_at = NULL,
+		    completed_at = CURRENT_TIMESTAMP 
+		WHERE id = ?
+	`, message, id); err != nil {
+		return fmt.Errorf("failed to fail task: %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE tasks 
+		SET status = 'canceled',
+		    lease_expires_at = NULL
+		WHERE expression_id = ? AND status IN ('pending', 'waiting', 'in_progress')
+	`, expressionID); err != nil {
+		return fmt.Errorf("failed to cancel operations: %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE tasks 
+		SET status = 'failed', 
+		    error = ?,
+		    completed_at = CURRENT_TIMESTAMP 
+		WHERE id = ? AND status = 'pending'
+	`, message, expressionID); err != nil {
+		return fmt.Errorf("failed to fail expression: %w", err)
+	}
+	return nil
+}
+
+// RegisterWorker records an agent or updates its capacity. An empty
+// hostname keeps the one reported earlier.
+func (r *SQLiteRepository) RegisterWorker(worker Worker) error {
+	now := time.Now().Unix()
+	_, err := r.db.Exec(`
+		INSERT INTO workers (id, hostname, capacity, registered_at, last_seen)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			hostname = COALESCE(NULLIF(excluded.hostname, ''), workers.hostname),
+			capacity = excluded.capacity,
+			last_seen = excluded.last_seen
+	`, worker.ID, worker.Hostname, worker.Capacity, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to register worker: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) TouchWorker(id string) error {
+	res, err := r.db.Exec(
+		"UPDATE workers SET last_seen = ? WHERE id = ?",
+		time.Now().Unix(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update worker: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrWorkerNotFound
+	}
+	return nil
+}
+
+// GetWorkers lists known agents together with the operations they hold.
+func (r *SQLiteRepository) GetWorkers() ([]Worker, error) {
+	rows, err := r.db.Query(`
+		SELECT id, COALESCE(hostname, ''), capacity, registered_at, last_seen
+		FROM workers
+		ORDER BY last_seen DESC, id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workers: %w", err)
+	}
+
+	var workers []Worker
+	index := make(map[string]int)
+	for rows.Next() {
+		var (
+			w                      Worker
+			registeredAt, lastSeen int64
+		)
+		if err := rows.Scan(&w.ID, &w.Hostname, &w.Capacity, &registeredAt, &lastSeen); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan worker: %w", err)
+		}
+		w.RegisteredAt = time.Unix(registeredAt, 0).UTC()
+		w.LastSeen = time.Unix(lastSeen, 0).UTC()
+		index[w.ID] = len(workers)
+		workers = append(workers, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query workers: %w", err)
+	}
+
+	rows, err = r.db.Query(`
+		SELECT worker_id, id
+		FROM tasks
+		WHERE status = 'in_progress' AND worker_id IS NOT NULL
+		ORDER BY started_at, id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query assignments: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var workerID, taskID string
+		if err := rows.Scan(&workerID, &taskID); err != nil {
+			return nil, fmt.Errorf("failed to scan assignment: %w", err)
+		}
+		if i, ok := index[workerID]; ok {
+			workers[i].Tasks = append(workers[i].Tasks, taskID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query assignments: %w", err)
+	}
+	return workers, nil
+}
+
 func (r *SQLiteRepository) GetUserTasks(userID int) ([]Task, error) {
 	rows, err := r.db.Query(`
-		SELECT id, expression, status, result, created_at, completed_at
+		SELECT `+taskColumns+`
 		FROM tasks
-		WHERE user_id = ?
-		ORDER BY created_at DESC
+		WHERE user_id = ? AND expression_id IS NULL
+		ORDER BY created_at DESC, id DESC
 	`, userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query tasks: %w", err)
@@ -164,49 +994,213 @@ func (r *SQLiteRepository) GetUserTasks(userID int) ([]Task, error) {
 
 	var tasks []Task
 	for rows.Next() {
-		var task Task
-		err := rows.Scan(
-			&task.ID,
-			&task.Expression,
-			&task.Status,
-			&task.Result,
-			&task.CreatedAt,
-			&task.CompletedAt,
-		)
+		task, err := scanTask(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan task: %w", err)
 		}
-		tasks = append(tasks, task)
+		tasks = append(tasks, *task)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query tasks: %w", err)
 	}
 	return tasks, nil
 }
 
 func (r *SQLiteRepository) GetTaskByID(id string) (*Task, error) {
-	var task Task
-	err := r.db.QueryRow(`
-		SELECT id, user_id, expression, status, result, 
-		       created_at, started_at, completed_at
+	task, err := scanTask(r.db.QueryRow(`
+		SELECT `+taskColumns+`
 		FROM tasks
 		WHERE id = ?
-	`, id).Scan(
-		&task.ID,
-		&task.UserID,
-		&task.Expression,
-		&task.Status,
-		&task.Result,
-		&task.CreatedAt,
-		&task.StartedAt,
-		&task.CompletedAt,
-	)
+	`, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrTaskNotFound
 		}
 		return nil, fmt.Errorf("failed to get task: %w", err)
 	}
+	return task, nil
+}
+
+// GetVariables lists the variables of a user ordered by name.
+func (r *SQLiteRepository) GetVariables(userID int) ([]Variable, error) {
+	rows, err := r.db.Query(`
+		SELECT name, value, updated_at
+		FROM variables
+		WHERE user_id = ?
+		ORDER BY name
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query variables: %w", err)
+	}
+	defer rows.Close()
+
+	var variables []Variable
+	for rows.Next() {
+		v, err := scanVariable(rows)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, *v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query variables: %w", err)
+	}
+	return variables, nil
+}
+
+func (r *SQLiteRepository) GetVariable(userID int, name string) (*Variable, error) {
+	v, err := scanVariable(r.db.QueryRow(
+		"SELECT name, value, updated_at FROM variables WHERE user_id = ? AND name = ?",
+		userID, name,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrVariableNotFound
+	}
+	return v, err
+}
+
+// scanVariable reads a row selected as name, value, updated_at.
+func scanVariable(row rowScanner) (*Variable, error) {
+	var (
+		v         Variable
+		updatedAt int64
+	)
+	if err := row.Scan(&v.Name, &v.Value, &updatedAt); err != nil {
+		return nil, fmt.Errorf("failed to scan variable: %w", err)
+	}
+	v.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+	return &v, nil
+}
+
+// SetVariable creates the variable or replaces its value.
+func (r *SQLiteRepository) SetVariable(userID int, name string, value string) (*Variable, error) {
+	now := time.Now()
+	if err := setVariable(r.db, userID, name, value, now); err != nil {
+		return nil, err
+	}
+	return &Variable{Name: name, Value: value, UpdatedAt: time.Unix(now.Unix(), 0).UTC()}, nil
+}
+
+func (r *SQLiteRepository) DeleteVariable(userID int, name string) error {
+	res, err := r.db.Exec(
+		"DELETE FROM variables WHERE user_id = ? AND name = ?",
+		userID, name,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete variable: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrVariableNotFound
+	}
+	return nil
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// setVariable stores value as text, so that fractions and complex numbers
+// are kept exactly.
+func setVariable(db execer, userID int, name, value string, now time.Time) error {
+	if err := calculator.CheckValue(value); err != nil {
+		return fmt.Errorf("invalid value of %s: %w", name, err)
+	}
+	_, err := db.Exec(`
+		INSERT INTO variables (user_id, name, value, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, name) DO UPDATE SET
+			value = excluded.value,
+			updated_at = excluded.updated_at
+	`, userID, name, value, now.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to set variable %s: %w", name, err)
+	}
+	return nil
+}
+
+const taskColumns = `id, user_id, expression_id, expression, arg1, arg2, operation, mode,
+		       status, result, result_text, error, attempts, worker_id, created_at, started_at, completed_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanTask reads a row selected with taskColumns. Columns that are not
+// filled yet (e.g. the result of a pending task) are left as zero values.
+func scanTask(row rowScanner) (*Task, error) {
+	var (
+		task                              Task
+		expressionID, expression          sql.NullString
+		arg1, arg2, operation, taskErr    sql.NullString
+		workerID                          sql.NullString
+		result                            sql.NullFloat64
+		resultText                        sql.NullString
+		createdAt, startedAt, completedAt sql.NullTime
+	)
+	err := row.Scan(
+		&task.ID,
+		&task.UserID,
+		&expressionID,
+		&expression,
+		&arg1,
+		&arg2,
+		&operation,
+		&task.Mode,
+		&task.Status,
+		&result,
+		&resultText,
+		&taskErr,
+		&task.Attempts,
+		&workerID,
+		&createdAt,
+		&startedAt,
+		&completedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	task.ExpressionID = expressionID.String
+	task.Expression = expression.String
+	task.Arg1 = arg1.String
+	task.Arg2 = arg2.String
+	task.Operation = operation.String
+	switch {
+	case resultText.Valid:
+		task.Result = resultText.String
+	case result.Valid:
+		task.Result = strconv.FormatFloat(result.Float64, 'g', -1, 64)
+	}
+	task.Error = taskErr.String
+	task.WorkerID = workerID.String
+	task.CreatedAt = createdAt.Time
+	task.StartedAt = startedAt.Time
+	task.CompletedAt = completedAt.Time
 	return &task, nil
 }
 
 func generateTaskID() string {
 	return fmt.Sprintf("task_%d", time.Now().UnixNano())
 }
+
+func operationID(taskID string, index int) string {
+	return fmt.Sprintf("%s_%d", taskID, index)
+}
+
+func operandValue(o calculator.Operand) sql.NullString {
+	if o.IsRef() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: o.Value, Valid: true}
+}
+
+// IsTransient reports whether err is caused by a temporary condition of the
+// database, such as a lock held by another connection, so that the failed
+// call may succeed when retried.
+func IsTransient(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return errors.Is(err, sql.ErrConnDone)
+}
@@ -0,0 +1,767 @@
+package repository
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zubrodin/calc-service/pkg/calculator"
+)
+
+const testUserID = 1
+
+func newTestRepository(t *testing.T) *SQLiteRepository {
+	t.Helper()
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "calc.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func createTestTask(t *testing.T, repo *SQLiteRepository, expr string, mode calculator.Mode) string {
+	t.Helper()
+	plan, err := calculator.New().Decompose(expr, mode, nil)
+	if err != nil {
+		t.Fatalf("Decompose(%q) error = %v", expr, err)
+	}
+	id, err := repo.CreateTask(testUserID, expr, mode, plan)
+	if err != nil {
+		t.Fatalf("CreateTask(%q) error = %v", expr, err)
+	}
+	return id
+}
+
+func getTestTask(t *testing.T, repo *SQLiteRepository, id string) *Task {
+	t.Helper()
+	task, err := repo.GetTaskByID(id)
+	if err != nil {
+		t.Fatalf("GetTaskByID(%q) error = %v", id, err)
+	}
+	return task
+}
+
+// computeAll hands out the operations of all expressions one by one and
+// submits their results as an agent would.
+func computeAll(t *testing.T, repo *SQLiteRepository) {
+	t.Helper()
+	for {
+		task, err := repo.GetPendingTask("worker-1", time.Minute)
+		if err != nil {
+			t.Fatalf("GetPendingTask() error = %v", err)
+		}
+		if task == nil {
+			return
+		}
+		args := []string{task.Arg1}
+		if task.Arity == 2 {
+			args = append(args, task.Arg2)
+		}
+		result, err := calculator.Apply(calculator.Mode(task.Mode), task.Operation, args)
+		if err != nil {
+			if err := repo.SaveError(task.ID, "worker-1", err.Error()); err != nil {
+				t.Fatalf("SaveError(%q) error = %v", task.ID, err)
+			}
+			continue
+		}
+		if err := repo.SaveResult(task.ID, "worker-1", result); err != nil {
+			t.Fatalf("SaveResult(%q) error = %v", task.ID, err)
+		}
+	}
+}
+
+func TestTaskGraph(t *testing.T) {
+	tests := []struct {
+		name       string
+		expr       string
+		mode       calculator.Mode
+		wantStatus string
+		wantResult string
+		wantError  string
+		wantVars   map[string]string
+	}{
+		{"single operation", "2+3", calculator.ModeFloat, StatusCompleted, "5", "", nil},
+		{"result passed to parent", "2+3*4", calculator.ModeFloat, StatusCompleted, "14", "", nil},
+		{"both arguments computed", "(1+2)*(3+4)", calculator.ModeFloat, StatusCompleted, "21", "", nil},
+		{"left argument computed", "(8-2)/3", calculator.ModeFloat, StatusCompleted, "2", "", nil},
+		{"number without operations", "7", calculator.ModeFloat, StatusCompleted, "7", "", nil},
+		{"unary minus", "-(2+3)*2", calculator.ModeFloat, StatusCompleted, "-10", "", nil},
+		{"negative number", "-7", calculator.ModeFloat, StatusCompleted, "-7", "", nil},
+		{"right-associative power", "2^3^2", calculator.ModeFloat, StatusCompleted, "512", "", nil},
+		{"unary function", "sqrt(3*3+7)+1", calculator.ModeFloat, StatusCompleted, "5", "", nil},
+		{"function with several arguments", "max(1, 2*4, 3)", calculator.ModeFloat, StatusCompleted, "8", "", nil},
+		{"constant", "2*pi", calculator.ModeFloat, StatusCompleted, strconv.FormatFloat(2*math.Pi, 'g', -1, 64), "", nil},
+		{"decimal result kept exact", "1/3", calculator.ModeDecimal, StatusCompleted, "1/3", "", nil},
+		{"decimal sum", "0.1+0.2", calculator.ModeDecimal, StatusCompleted, "3/10", "", nil},
+		{"complex result", "(1+i)*(1+i)", calculator.ModeComplex, StatusCompleted, "2i", "", nil},
+		{"assignment", "x = 2*3; x+1", calculator.ModeFloat, StatusCompleted, "7", "", map[string]string{"x": "6"}},
+		{"assignment before a number", "y = 2*3; 7", calculator.ModeFloat, StatusCompleted, "7", "", map[string]string{"y": "6"}},
+		{"assignment of a number", "z = 5; z*2", calculator.ModeFloat, StatusCompleted, "10", "", map[string]string{"z": "5"}},
+		{"complex assignment", "x = i*i*i; x+1", calculator.ModeComplex, StatusCompleted, "1-1i",
+			"", map[string]string{"x": "-1i"}},
+		{"decimal assignment kept exact", "x = 1/3; x*3", calculator.ModeDecimal, StatusCompleted, "1",
+			"", map[string]string{"x": "1/3"}},
+		{"result used twice", "x = 1+2; x*x", calculator.ModeFloat, StatusCompleted, "9", "", map[string]string{"x": "3"}},
+		{"result assigned twice", "x = 2*3; y = x; x+y", calculator.ModeFloat, StatusCompleted, "12",
+			"", map[string]string{"x": "6", "y": "6"}},
+		{"repeated squaring", "x = 1+1; x = x*x; x = x*x; x = x*x; x = x*x; x = x*x; x", calculator.ModeDecimal, StatusCompleted,
+			"4294967296", "", map[string]string{"x": "4294967296"}},
+		{"failed function", "sqrt(1-2)", calculator.ModeFloat, StatusFailed, "", "result is complex; use mode complex", nil},
+		{"failed operation", "1/(2-2)+3", calculator.ModeFloat, StatusFailed, "", "division by zero", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepository(t)
+			id := createTestTask(t, repo, tt.expr, tt.mode)
+			computeAll(t, repo)
+
+			task := getTestTask(t, repo, id)
+			if task.Status != tt.wantStatus {
+				t.Fatalf("status = %s, want %s (error %q)", task.Status, tt.wantStatus, task.Error)
+			}
+			if task.Result != tt.wantResult {
+				t.Errorf("result = %q, want %q", task.Result, tt.wantResult)
+			}
+			if task.Error != tt.wantError {
+				t.Errorf("error = %q, want %q", task.Error, tt.wantError)
+			}
+			if task.CompletedAt.IsZero() {
+				t.Error("completed_at is not set")
+			}
+			for name, want := range tt.wantVars {
+				v, err := repo.GetVariable(testUserID, name)
+				if err != nil {
+					t.Fatalf("GetVariable(%q) error = %v", name, err)
+				}
+				if v.Value != want {
+					t.Errorf("variable %s = %q, want %q", name, v.Value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetPendingTaskWaitsForArguments(t *testing.T) {
+	repo := newTestRepository(t)
+	id := createTestTask(t, repo, "2+3*4", calculator.ModeFloat)
+
+	op, err := repo.GetPendingTask("worker-1", time.Minute)
+	if err != nil || op == nil {
+		t.Fatalf("GetPendingTask() = %v, %v, want an operation", op, err)
+	}
+	if op.Operation != "*" || op.ExpressionID != id {
+		t.Fatalf("GetPendingTask() = %s of %s, want * of %s", op.Operation, op.ExpressionID, id)
+	}
+	if next, err := repo.GetPendingTask("worker-1", time.Minute); err != nil || next != nil {
+		t.Fatalf("GetPendingTask() before the argument is ready = %v, %v, want nil", next, err)
+	}
+
+	if err := repo.SaveResult(op.ID, "worker-1", "12"); err != nil {
+		t.Fatalf("SaveResult() error = %v", err)
+	}
+	next, err := repo.GetPendingTask("worker-1", time.Minute)
+	if err != nil || next == nil {
+		t.Fatalf("GetPendingTask() = %v, %v, want the parent operation", next, err)
+	}
+	if next.Operation != "+" || next.Arg1 != "2" || next.Arg2 != "12" {
+		t.Errorf("parent = %s %s %s, want 2 + 12", next.Arg1, next.Operation, next.Arg2)
+	}
+}
+
+func TestGetUserTasks(t *testing.T) {
+	repo := newTestRepository(t)
+	first := createTestTask(t, repo, "1+1", calculator.ModeFloat)
+	second := createTestTask(t, repo, "2*2", calculator.ModeFloat)
+	if _, err := repo.CreateTask(testUserID+1, "3", calculator.ModeFloat, &calculator.Plan{Result: calculator.Operand{Value: "3", Ref: -1}}); err != nil {
+		t.Fatalf("CreateTask() error = %v", err)
+	}
+
+	tasks, err := repo.GetUserTasks(testUserID)
+	if err != nil {
+		t.Fatalf("GetUserTasks() error = %v", err)
+	}
+	// Operations are not listed, and the newest expression comes first.
+	if len(tasks) != 2 || tasks[0].ID != second || tasks[1].ID != first {
+		t.Fatalf("GetUserTasks() = %+v, want expressions %s and %s", tasks, second, first)
+	}
+	if tasks[0].Status != StatusPending || tasks[0].Expression != "2*2" {
+		t.Errorf("GetUserTasks()[0] = %s %q, want %s %q", tasks[0].Status, tasks[0].Expression, StatusPending, "2*2")
+	}
+}
+
+// leaseTestTask leases the next pending operation and checks that it is
+// the one expected.
+func leaseTestTask(t *testing.T, repo *SQLiteRepository, workerID, operation string) *Task {
+	t.Helper()
+	task, err := repo.GetPendingTask(workerID, time.Minute)
+	if err != nil {
+		t.Fatalf("GetPendingTask() error = %v", err)
+	}
+	if task == nil {
+		t.Fatalf("GetPendingTask() = nil, want operation %s", operation)
+	}
+	if task.Operation != operation {
+		t.Fatalf("GetPendingTask() operation = %s, want %s", task.Operation, operation)
+	}
+	return task
+}
+
+func TestExpressionCompletesAfterAssignments(t *testing.T) {
+	repo := newTestRepository(t)
+	id := createTestTask(t, repo, "y = 2*3; 7", calculator.ModeFloat)
+
+	if task := getTestTask(t, repo, id); task.Status != StatusPending {
+		t.Fatalf("status before the assignment = %s, want %s", task.Status, StatusPending)
+	}
+
+	op := leaseTestTask(t, repo, "worker-1", "*")
+	if err := repo.SaveResult(op.ID, "worker-1", "6"); err != nil {
+		t.Fatalf("SaveResult() error = %v", err)
+	}
+	if task := getTestTask(t, repo, id); task.Status != StatusCompleted || task.Result != "7" {
+		t.Errorf("expression = %s %q, want %s %q", task.Status, task.Result, StatusCompleted, "7")
+	}
+}
+
+func TestSaveResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		workerID string
+		result   string
+		// prepare runs after operation * of expr, 2+3*4 unless set, was
+		// leased to worker-1.
+		prepare func(t *testing.T, repo *SQLiteRepository, op *Task)
+		wantErr error
+	}{
+		{
+			name:     "leased worker",
+			workerID: "worker-1",
+			result:   "12",
+		},
+		{
+			name:     "other worker",
+			workerID: "worker-2",
+			result:   "12",
+			wantErr:  ErrTaskNotLeased,
+		},
+		{
+			name:     "same result twice",
+			workerID: "worker-1",
+			result:   "12",
+			prepare: func(t *testing.T, repo *SQLiteRepository, op *Task) {
+				if err := repo.SaveResult(op.ID, "worker-1", "12"); err != nil {
+					t.Fatalf("SaveResult() error = %v", err)
+				}
+			},
+		},
+		{
+			name:     "different result after completion",
+			workerID: "worker-1",
+			result:   "13",
+			prepare: func(t *testing.T, repo *SQLiteRepository, op *Task) {
+				if err := repo.SaveResult(op.ID, "worker-1", "12"); err != nil {
+					t.Fatalf("SaveResult() error = %v", err)
+				}
+			},
+			wantErr: ErrTaskNotInProgress,
+		},
+		{
+			name:     "lease released",
+			workerID: "worker-1",
+			result:   "12",
+			prepare: func(t *testing.T, repo *SQLiteRepository, op *Task) {
+				if _, err := repo.ReleaseLeases(); err != nil {
+					t.Fatalf("ReleaseLeases() error = %v", err)
+				}
+			},
+			wantErr: ErrTaskNotInProgress,
+		},
+		{
+			name:     "expression failed",
+			expr:     "3*4+1/0",
+			workerID: "worker-1",
+			result:   "12",
+			prepare: func(t *testing.T, repo *SQLiteRepository, op *Task) {
+				other := leaseTestTask(t, repo, "worker-2", "/")
+				if err := repo.SaveError(other.ID, "worker-2", "division by zero"); err != nil {
+					t.Fatalf("SaveError() error = %v", err)
+				}
+			},
+			wantErr: ErrTaskCanceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepository(t)
+			expr := tt.expr
+			if expr == "" {
+				expr = "2+3*4"
+			}
+			id := createTestTask(t, repo, expr, calculator.ModeFloat)
+			op := leaseTestTask(t, repo, "worker-1", "*")
+			if tt.prepare != nil {
+				tt.prepare(t, repo, op)
+			}
+
+			err := repo.SaveResult(op.ID, tt.workerID, tt.result)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SaveResult() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if got := getTestTask(t, repo, op.ID); got.Status != StatusCompleted || got.Result != "12" {
+				t.Errorf("operation = %s %q, want %s 12", got.Status, got.Result, StatusCompleted)
+			}
+			parent := leaseTestTask(t, repo, "worker-1", "+")
+			if parent.Arg2 != "12" {
+				t.Errorf("parent arg2 = %q, want %q", parent.Arg2, "12")
+			}
+			if task := getTestTask(t, repo, id); task.Status != StatusPending {
+				t.Errorf("expression status = %s, want %s", task.Status, StatusPending)
+			}
+		})
+	}
+}
+
+func TestSaveResultUnknownTask(t *testing.T) {
+	repo := newTestRepository(t)
+	id := createTestTask(t, repo, "2+3", calculator.ModeFloat)
+
+	for _, taskID := range []string{"missing", id} {
+		if err := repo.SaveResult(taskID, "worker-1", "5"); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("SaveResult(%q) error = %v, want %v", taskID, err, ErrTaskNotFound)
+		}
+	}
+}
+
+func TestSaveError(t *testing.T) {
+	repo := newTestRepository(t)
+	id := createTestTask(t, repo, "(1/0)+(2*3)", calculator.ModeFloat)
+
+	op := leaseTestTask(t, repo, "worker-1", "/")
+	if err := repo.SaveError(op.ID, "worker-1", "division by zero"); err != nil {
+		t.Fatalf("SaveError() error = %v", err)
+	}
+	if err := repo.SaveError(id, "worker-1", "division by zero"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("SaveError() of an expression error = %v, want %v", err, ErrTaskNotFound)
+	}
+
+	task := getTestTask(t, repo, id)
+	if task.Status != StatusFailed || task.Error != "division by zero" {
+		t.Errorf("expression = %s %q, want %s %q", task.Status, task.Error, StatusFailed, "division by zero")
+	}
+	// The other operations of the failed expression are not handed out.
+	if next, err := repo.GetPendingTask("worker-1", time.Minute); err != nil || next != nil {
+		t.Errorf("GetPendingTask() = %v, %v, want nil", next, err)
+	}
+}
+
+func TestReleaseExpiredLeases(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     int
+		maxAttempts  int
+		wantReleased int
+		wantFailed   int
+		wantStatus   string
+	}{
+		{"released", 1, 3, 1, 0, StatusPending},
+		{"attempts left", 2, 3, 1, 0, StatusPending},
+		{"out of attempts", 3, 3, 0, 1, StatusFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepository(t)
+			id := createTestTask(t, repo, "2+3", calculator.ModeFloat)
+
+			var op *Task
+			for i := 0; i < tt.attempts; i++ {
+				op = leaseTestTask(t, repo, "worker-1", "+")
+				expireLease(t, repo, op.ID)
+				if i < tt.attempts-1 {
+					if _, _, err := repo.ReleaseExpiredLeases(tt.maxAttempts); err != nil {
+						t.Fatalf("ReleaseExpiredLeases() error = %v", err)
+					}
+				}
+			}
+
+			released, failed, err := repo.ReleaseExpiredLeases(tt.maxAttempts)
+			if err != nil {
+				t.Fatalf("ReleaseExpiredLeases() error = %v", err)
+			}
+			if released != tt.wantReleased || failed != tt.wantFailed {
+				t.Errorf("ReleaseExpiredLeases() = %d, %d, want %d, %d",
+					released, failed, tt.wantReleased, tt.wantFailed)
+			}
+
+			if task := getTestTask(t, repo, id); task.Status != tt.wantStatus {
+				t.Errorf("expression status = %s, want %s", task.Status, tt.wantStatus)
+			}
+			if got := getTestTask(t, repo, op.ID); got.Attempts != tt.attempts {
+				t.Errorf("attempts = %d, want %d", got.Attempts, tt.attempts)
+			}
+			if err := repo.SaveResult(op.ID, "worker-1", "5"); err == nil {
+				t.Error("SaveResult() after the lease expired error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestReleaseExpiredLeasesSkipsFailedExpressions(t *testing.T) {
+	repo := newTestRepository(t)
+	createTestTask(t, repo, "3*4+1/0", calculator.ModeFloat)
+
+	op := leaseTestTask(t, repo, "worker-1", "*")
+	other := leaseTestTask(t, repo, "worker-2", "/")
+	if err := repo.SaveError(other.ID, "worker-2", "division by zero"); err != nil {
+		t.Fatalf("SaveError() error = %v", err)
+	}
+	expireLease(t, repo, op.ID)
+
+	released, failed, err := repo.ReleaseExpiredLeases(3)
+	if err != nil {
+		t.Fatalf("ReleaseExpiredLeases() error = %v", err)
+	}
+	if released != 0 || failed != 0 {
+		t.Errorf("ReleaseExpiredLeases() = %d, %d, want 0, 0", released, failed)
+	}
+	if got := getTestTask(t, repo, op.ID); got.Status != StatusCanceled {
+		t.Errorf("operation status = %s, want %s", got.Status, StatusCanceled)
+	}
+}
+
+func TestReleaseExpiredLeasesKeepsLiveLeases(t *testing.T) {
+	repo := newTestRepository(t)
+	createTestTask(t, repo, "2+3", calculator.ModeFloat)
+	op := leaseTestTask(t, repo, "worker-1", "+")
+
+	released, failed, err := repo.ReleaseExpiredLeases(3)
+	if err != nil {
+		t.Fatalf("ReleaseExpiredLeases() error = %v", err)
+	}
+	if released != 0 || failed != 0 {
+		t.Errorf("ReleaseExpiredLeases() = %d, %d, want 0, 0", released, failed)
+	}
+	if got := getTestTask(t, repo, op.ID); got.Status != StatusInProgress {
+		t.Errorf("operation status = %s, want %s", got.Status, StatusInProgress)
+	}
+}
+
+func TestReleaseLeases(t *testing.T) {
+	repo := newTestRepository(t)
+	createTestTask(t, repo, "2+3", calculator.ModeFloat)
+	createTestTask(t, repo, "4*5", calculator.ModeFloat)
+	first := leaseTestTask(t, repo, "worker-1", "+")
+	leaseTestTask(t, repo, "worker-1", "*")
+
+	released, err := repo.ReleaseLeases()
+	if err != nil {
+		t.Fatalf("ReleaseLeases() error = %v", err)
+	}
+	if released != 2 {
+		t.Errorf("ReleaseLeases() = %d, want 2", released)
+	}
+	// The interrupted attempt is not counted.
+	if got := getTestTask(t, repo, first.ID); got.Status != StatusPending || got.Attempts != 0 {
+		t.Errorf("operation = %s after %d attempts, want %s after 0", got.Status, got.Attempts, StatusPending)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	repo := newTestRepository(t)
+	if err := repo.TouchWorker("worker-1"); !errors.Is(err, ErrWorkerNotFound) {
+		t.Fatalf("TouchWorker() of an unknown worker error = %v, want %v", err, ErrWorkerNotFound)
+	}
+
+	if err := repo.RegisterWorker(Worker{ID: "worker-1", Hostname: "host-1", Capacity: 2}); err != nil {
+		t.Fatalf("RegisterWorker() error = %v", err)
+	}
+	// Registering again updates the capacity and keeps the hostname.
+	if err := repo.RegisterWorker(Worker{ID: "worker-1", Capacity: 4}); err != nil {
+		t.Fatalf("RegisterWorker() error = %v", err)
+	}
+	if err := repo.TouchWorker("worker-1"); err != nil {
+		t.Fatalf("TouchWorker() error = %v", err)
+	}
+
+	createTestTask(t, repo, "2+3", calculator.ModeFloat)
+	op := leaseTestTask(t, repo, "worker-1", "+")
+
+	workers, err := repo.GetWorkers()
+	if err != nil {
+		t.Fatalf("GetWorkers() error = %v", err)
+	}
+	if len(workers) != 1 {
+		t.Fatalf("GetWorkers() = %+v, want one worker", workers)
+	}
+	w := workers[0]
+	if w.ID != "worker-1" || w.Hostname != "host-1" || w.Capacity != 4 {
+		t.Errorf("worker = %+v, want worker-1 on host-1 with capacity 4", w)
+	}
+	if len(w.Tasks) != 1 || w.Tasks[0] != op.ID {
+		t.Errorf("worker tasks = %v, want [%s]", w.Tasks, op.ID)
+	}
+	if got := getTestTask(t, repo, op.ID); got.WorkerID != "worker-1" {
+		t.Errorf("operation worker = %q, want %q", got.WorkerID, "worker-1")
+	}
+}
+
+func expireLease(t *testing.T, repo *SQLiteRepository, id string) {
+	t.Helper()
+	if _, err := repo.db.Exec(
+		"UPDATE tasks SET lease_expires_at = ? WHERE id = ?",
+		time.Now().Add(-time.Second).Unix(), id,
+	); err != nil {
+		t.Fatalf("failed to expire lease: %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	repo := newTestRepository(t)
+	if _, err := repo.CreateUser("user1", "password123"); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	// Users created before hashing was introduced have plain passwords.
+	if _, err := repo.db.Exec(
+		"INSERT INTO users (login, password) VALUES (?, ?)",
+		"legacy", "password123",
+	); err != nil {
+		t.Fatalf("failed to create legacy user: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		login    string
+		password string
+		wantErr  error
+	}{
+		{"hashed password", "user1", "password123", nil},
+		{"wrong password", "user1", "password124", ErrInvalidPassword},
+		{"unknown user", "nobody", "password123", ErrUserNotFound},
+		{"plain password", "legacy", "password123", nil},
+		{"wrong plain password", "legacy", "password124", ErrInvalidPassword},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := repo.Authenticate(tt.login, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && user.Login != tt.login {
+				t.Errorf("Authenticate() login = %q, want %q", user.Login, tt.login)
+			}
+		})
+	}
+
+	user, err := repo.GetUserByLogin("legacy")
+	if err != nil {
+		t.Fatalf("GetUserByLogin() error = %v", err)
+	}
+	if !strings.HasPrefix(user.Password, "$2") {
+		t.Errorf("plain password was not replaced with a hash: %q", user.Password)
+	}
+	if _, err := repo.Authenticate("legacy", "password123"); err != nil {
+		t.Errorf("Authenticate() after the upgrade error = %v", err)
+	}
+}
+
+func TestCreateUserExists(t *testing.T) {
+	repo := newTestRepository(t)
+	if _, err := repo.CreateUser("user1", "password123"); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if _, err := repo.CreateUser("user1", "password456"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("CreateUser() error = %v, want %v", err, ErrUserExists)
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare runs after tokens "a" and "b" of user 1 and "c" of user 2
+		// were saved.
+		prepare func(t *testing.T, repo *SQLiteRepository)
+		token   string
+		wantErr error
+	}{
+		{
+			name:  "valid",
+			token: "a",
+		},
+		{
+			name:    "unknown",
+			token:   "x",
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name:    "expired",
+			token:   "expired",
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name: "used",
+			prepare: func(t *testing.T, repo *SQLiteRepository) {
+				if _, err := repo.UseRefreshToken("a"); err != nil {
+					t.Fatalf("UseRefreshToken() error = %v", err)
+				}
+			},
+			token:   "a",
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name: "other token of a user whose used token was presented",
+			prepare: func(t *testing.T, repo *SQLiteRepository) {
+				repo.UseRefreshToken("a")
+				repo.UseRefreshToken("a")
+			},
+			token:   "b",
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name: "revoked on logout",
+			prepare: func(t *testing.T, repo *SQLiteRepository) {
+				if err := repo.RevokeRefreshToken(1, "a"); err != nil {
+					t.Fatalf("RevokeRefreshToken() error = %v", err)
+				}
+			},
+			token:   "a",
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name: "revoked by another user",
+			prepare: func(t *testing.T, repo *SQLiteRepository) {
+				if err := repo.RevokeRefreshToken(2, "a"); err != nil {
+					t.Fatalf("RevokeRefreshToken() error = %v", err)
+				}
+			},
+			token: "a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepository(t)
+			for _, login := range []string{"user1", "user2"} {
+				if _, err := repo.CreateUser(login, "password123"); err != nil {
+					t.Fatalf("CreateUser() error = %v", err)
+				}
+			}
+			expiresAt := time.Now().Add(time.Hour)
+			for _, tok := range []struct {
+				userID int
+				hash   string
+				expiry time.Time
+			}{
+				{1, "a", expiresAt},
+				{1, "b", expiresAt},
+				{2, "c", expiresAt},
+				{1, "expired", time.Now().Add(-time.Second)},
+			} {
+				if err := repo.SaveRefreshToken(tok.userID, tok.hash, tok.expiry); err != nil {
+					t.Fatalf("SaveRefreshToken() error = %v", err)
+				}
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, repo)
+			}
+
+			user, err := repo.UseRefreshToken(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UseRefreshToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && user.ID != 1 {
+				t.Errorf("UseRefreshToken() user = %d, want 1", user.ID)
+			}
+
+			// Tokens of other users are never affected.
+			if _, err := repo.UseRefreshToken("c"); err != nil {
+				t.Errorf("UseRefreshToken() of another user error = %v", err)
+			}
+		})
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	repo := newTestRepository(t)
+	if err := repo.RevokeToken("old", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+	if err := repo.RevokeToken("current", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+	if err := repo.RevokeToken("current", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeToken() twice error = %v", err)
+	}
+
+	tests := []struct {
+		tokenID string
+		want    bool
+	}{
+		{"current", true},
+		// Entries of expired tokens are dropped on the next revocation.
+		{"old", false},
+		{"unknown", false},
+	}
+	for _, tt := range tests {
+		got, err := repo.IsTokenRevoked(tt.tokenID)
+		if err != nil {
+			t.Fatalf("IsTokenRevoked(%q) error = %v", tt.tokenID, err)
+		}
+		if got != tt.want {
+			t.Errorf("IsTokenRevoked(%q) = %v, want %v", tt.tokenID, got, tt.want)
+		}
+	}
+}
+
+func TestVariables(t *testing.T) {
+	repo := newTestRepository(t)
+	if _, err := repo.GetVariable(testUserID, "x"); !errors.Is(err, ErrVariableNotFound) {
+		t.Fatalf("GetVariable() of a missing variable error = %v, want %v", err, ErrVariableNotFound)
+	}
+
+	for _, name := range []string{"y", "x"} {
+		if _, err := repo.SetVariable(testUserID, name, "1"); err != nil {
+			t.Fatalf("SetVariable(%q) error = %v", name, err)
+		}
+	}
+	v, err := repo.SetVariable(testUserID, "x", "1/3")
+	if err != nil || v.Value != "1/3" {
+		t.Fatalf("SetVariable() = %+v, %v, want x = 1/3", v, err)
+	}
+	if v, err := repo.GetVariable(testUserID, "x"); err != nil || v.Value != "1/3" {
+		t.Errorf("GetVariable() = %+v, %v, want x = 1/3", v, err)
+	}
+	if _, err := repo.GetVariable(testUserID+1, "x"); !errors.Is(err, ErrVariableNotFound) {
+		t.Errorf("GetVariable() of another user error = %v, want %v", err, ErrVariableNotFound)
+	}
+	if _, err := repo.SetVariable(testUserID, "x", "NaN"); err == nil {
+		t.Error("SetVariable() of NaN error = nil, want an invalid value")
+	}
+
+	variables, err := repo.GetVariables(testUserID)
+	if err != nil {
+		t.Fatalf("GetVariables() error = %v", err)
+	}
+	if len(variables) != 2 || variables[0].Name != "x" || variables[1].Name != "y" {
+		t.Errorf("GetVariables() = %+v, want x and y", variables)
+	}
+
+	if err := repo.DeleteVariable(testUserID, "x"); err != nil {
+		t.Fatalf("DeleteVariable() error = %v", err)
+	}
+	if err := repo.DeleteVariable(testUserID, "x"); !errors.Is(err, ErrVariableNotFound) {
+		t.Errorf("DeleteVariable() twice error = %v, want %v", err, ErrVariableNotFound)
+	}
+}
@@ -1,36 +1,156 @@
 package service
 
 import (
-	"github.com/zubrodin/calc-service/internal/storage"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zubrodin/calc-service/internal/repository"
 	"github.com/zubrodin/calc-service/pkg/calculator"
 	"github.com/zubrodin/calc-service/pkg/validator"
 )
 
-var ErrInvalidExpression = validator.ErrInvalidExpression
+var (
+	ErrInvalidExpression = validator.ErrInvalidExpression
+	ErrInvalidVariable   = errors.New("Variable name is not valid")
+	ErrInvalidValue      = errors.New("Variable value must be a number, a fraction such as 1/3 or a complex number such as 1+2i")
+	ErrInvalidResult     = errors.New("Result must be a finite number, a fraction such as 1/3 or a complex number such as 1+2i")
+)
 
 type Service struct {
 	calculator *calculator.Calculator
 	validator  *validator.Validator
-	storage    storage.Storage
+	repo       repository.Repository
+
+	mu    sync.Mutex
+	ready chan struct{}
 }
 
-func New(calc *calculator.Calculator, valid *validator.Validator, storage storage.Storage) *Service {
+func New(calc *calculator.Calculator, valid *validator.Validator, repo repository.Repository) *Service {
 	return &Service{
 		calculator: calc,
 		validator:  valid,
-		storage:    storage,
+		repo:       repo,
+		ready:      make(chan struct{}),
 	}
 }
 
-func (s *Service) Calculate(expr string) (float64, error) {
+// TasksReady returns a channel that is closed as soon as new operations may
+// have become ready for agents. Take the channel before looking for tasks,
+// otherwise a notification may be missed.
+func (s *Service) TasksReady() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+func (s *Service) notifyTasksReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.ready)
+	s.ready = make(chan struct{})
+}
+
+// Submit validates the expression, splits it into operations for the agents
+// and stores it. The returned ID identifies the expression. Variables of the
+// user are replaced with their current values; agents compute the
+// operations in the given mode.
+func (s *Service) Submit(userID int, expr string, mode calculator.Mode) (string, error) {
 	if err := s.validator.Validate(expr); err != nil {
-		return 0, ErrInvalidExpression
+		return "", invalidExpression(err)
+	}
+
+	variables, err := s.repo.GetVariables(userID)
+	if err != nil {
+		return "", err
+	}
+	vars := make(map[string]string, len(variables))
+	for _, v := range variables {
+		vars[v.Name] = v.Value
+	}
+
+	plan, err := s.calculator.Decompose(expr, mode, vars)
+	if err != nil {
+		return "", invalidExpression(err)
 	}
 
-	result, err := s.calculator.Calculate(expr)
+	id, err := s.repo.CreateTask(userID, expr, mode, plan)
 	if err != nil {
-		return 0, err
+		return "", err
+	}
+
+	s.notifyTasksReady()
+	return id, nil
+}
+
+// invalidExpression returns the *calculator.Error locating the problem in
+// the expression or, if there is none, ErrInvalidExpression.
+func invalidExpression(err error) error {
+	var exprErr *calculator.Error
+	if errors.As(err, &exprErr) {
+		return exprErr
+	}
+	return ErrInvalidExpression
+}
+
+// SetVariable stores a value under name for use in later expressions.
+func (s *Service) SetVariable(userID int, name string, value string) (*repository.Variable, error) {
+	if err := calculator.CheckVariableName(name); err != nil {
+		return nil, ErrInvalidVariable
+	}
+	if err := calculator.CheckValue(value); err != nil {
+		return nil, ErrInvalidValue
+	}
+	return s.repo.SetVariable(userID, name, value)
+}
+
+// SaveResult stores the result of an operation computed by workerID. The
+// operation that was waiting for it may become ready. A result that is not
+// a value Apply returns, such as "abc" or "NaN", fails the operation and
+// ErrInvalidResult is returned.
+func (s *Service) SaveResult(id, workerID, result string) error {
+	if err := calculator.CheckValue(result); err != nil {
+		if err := s.repo.SaveError(id, workerID, "agent reported an invalid result"); err != nil {
+			return err
+		}
+		return ErrInvalidResult
+	}
+	if err := s.repo.SaveResult(id, workerID, result); err != nil {
+		return err
 	}
 
-	return result, nil
+	s.notifyTasksReady()
+	return nil
+}
+
+func (s *Service) SaveError(id, workerID, message string) error {
+	return s.repo.SaveError(id, workerID, message)
+}
+
+// ReapExpiredLeases periodically returns operations abandoned by crashed
+// agents to the queue until ctx is canceled.
+func (s *Service) ReapExpiredLeases(ctx context.Context, interval time.Duration, maxAttempts int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			released, failed, err := s.repo.ReleaseExpiredLeases(maxAttempts)
+			if err != nil {
+				log.Printf("Failed to release expired leases: %v", err)
+				continue
+			}
+			if released > 0 || failed > 0 {
+				log.Printf("Expired leases: %d tasks returned to queue, %d failed", released, failed)
+			}
+			if released > 0 {
+				s.notifyTasksReady()
+			}
+		}
+	}
 }
@@ -0,0 +1,60 @@
+package calculator
+
+// Node is a node of the syntax tree of an expression.
+type Node interface {
+	// Pos is the byte offset of the node in the source.
+	Pos() int
+}
+
+// Number is a numeric literal. Imaginary literals end with i: 2i, or 1i for
+// the imaginary unit itself.
+type Number struct {
+	Value  string
+	Offset int
+}
+
+// Name is a reference to a constant or a variable.
+type Name struct {
+	Name   string
+	Offset int
+}
+
+// Unary is a negation, -X. Unary plus does not appear in the tree.
+type Unary struct {
+	Op     string
+	X      Node
+	Offset int
+}
+
+// Binary is an operator applied to X and Y. Offset is the position of the
+// operator or, for an implicit multiplication, of Y.
+type Binary struct {
+	Op     string
+	X, Y   Node
+	Offset int
+}
+
+// Call is a call of a built-in function.
+type Call struct {
+	Func   string
+	Args   []Node
+	Offset int
+}
+
+func (n *Number) Pos() int { return n.Offset }
+func (n *Name) Pos() int   { return n.Offset }
+func (n *Unary) Pos() int  { return n.Offset }
+func (n *Binary) Pos() int { return n.Offset }
+func (n *Call) Pos() int   { return n.Offset }
+
+// Statement is an expression, optionally assigned to the variable Name.
+type Statement struct {
+	Name   string
+	Value  Node
+	Offset int
+}
+
+// Program is a parsed source: statements separated by ";".
+type Program struct {
+	Statements []Statement
+}
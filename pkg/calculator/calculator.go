@@ -2,147 +2,243 @@ package calculator
 
 import (
 	"fmt"
-	"strconv"
+	"math"
 	"strings"
 )
 
-type Calculator struct{}
-
-func New() *Calculator {
-	return &Calculator{}
+type Calculator struct {
+	implicitMultiplication bool
 }
 
-func (c *Calculator) Calculate(expr string) (float64, error) {
-	expr = strings.ReplaceAll(expr, " ", "")
+// Option configures a Calculator.
+type Option func(*Calculator)
 
-	rpn, err := c.toRPN(expr)
-	if err != nil {
-		return 0, err
+// WithImplicitMultiplication makes a number, name or opening parenthesis
+// that directly follows a number, name or closing parenthesis a
+// multiplication, e.g. 2(3+4), (1+2)(3+4) or 2pi.
+func WithImplicitMultiplication(enabled bool) Option {
+	return func(c *Calculator) {
+		c.implicitMultiplication = enabled
 	}
+}
 
-	result, err := c.evaluateRPN(rpn)
-	if err != nil {
-		return 0, err
-	}
+// Operand is an argument of an Operation: either a literal number
+// or a reference to the result of another operation in the same plan.
+type Operand struct {
+	Value string
+	Ref   int
+}
 
-	return result, nil
+// IsRef reports whether the operand refers to the result of another operation.
+func (o Operand) IsRef() bool {
+	return o.Ref >= 0
 }
 
-func (c *Calculator) toRPN(expr string) ([]string, error) {
-	var output []string
-	var operators []string
+// Operation is a single operation of a decomposed expression: an operator
+// applied to two arguments, or a function applied to one or two.
+type Operation struct {
+	Operator string
+	Args     []Operand
+}
 
-	for i := 0; i < len(expr); {
-		char := string(expr[i])
+// Plan is an expression decomposed into operations.
+// Operations are ordered so that every reference points to an earlier
+// operation, and the result of an operation may be referred to several
+// times; Result is the operand holding the value of the whole expression
+// (of its last statement, for a program). Assignments lists the variables the
+// program sets.
+type Plan struct {
+	Operations  []Operation
+	Result      Operand
+	Assignments []Assignment
+}
 
-		if c.isDigit(char) {
-			j := i
-			for j < len(expr) && (c.isDigit(string(expr[j])) || string(expr[j]) == ".") {
-				j++
-			}
-			output = append(output, expr[i:j])
-			i = j
-		} else if char == "(" {
-			operators = append(operators, char)
-			i++
-		} else if char == ")" {
-			for len(operators) > 0 && operators[len(operators)-1] != "(" {
-				output = append(output, operators[len(operators)-1])
-				operators = operators[:len(operators)-1]
-			}
-			if len(operators) == 0 {
-				return nil, fmt.Errorf("mismatched parentheses")
-			}
-			operators = operators[:len(operators)-1]
-			i++
-		} else if c.isOperator(char) {
-			for len(operators) > 0 && c.precedence(operators[len(operators)-1]) >= c.precedence(char) {
-				output = append(output, operators[len(operators)-1])
-				operators = operators[:len(operators)-1]
-			}
-			operators = append(operators, char)
-			i++
-		} else {
-			return nil, fmt.Errorf("invalid character: %s", char)
+func New(opts ...Option) *Calculator {
+	c := &Calculator{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Decompose parses expr and splits it into independent operations that can
+// be evaluated separately, e.g. by remote agents, in the given mode. Names
+// that are not assigned earlier in expr are looked up in vars, which hold
+// values computed in any mode. Errors are of type *Error.
+func (c *Calculator) Decompose(expr string, mode Mode, vars map[string]string) (*Plan, error) {
+	prog, err := c.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := builder{mode: mode}
+	// scope holds the values of the variables assigned so far.
+	scope := make(map[string]Operand)
+	lookup := func(n *Name) (Operand, error) {
+		if o, ok := scope[n.Name]; ok {
+			return o, nil
 		}
+		v, ok := vars[n.Name]
+		if !ok {
+			return Operand{}, undefined(n)
+		}
+		value, err := convert(v, mode)
+		if err != nil {
+			return Operand{}, &Error{Offset: n.Offset, Message: fmt.Sprintf("variable %s: %v", n.Name, err)}
+		}
+		return Operand{Value: value, Ref: -1}, nil
 	}
 
-	for len(operators) > 0 {
-		if operators[len(operators)-1] == "(" {
-			return nil, fmt.Errorf("mismatched parentheses")
+	for _, st := range prog.Statements {
+		value, err := b.build(st.Value, lookup)
+		if err != nil {
+			return nil, withSource(err, expr)
+		}
+		if st.Name != "" {
+			b.assign(st.Name, value)
+			scope[st.Name] = value
 		}
-		output = append(output, operators[len(operators)-1])
-		operators = operators[:len(operators)-1]
+		b.plan.Result = value
 	}
 
-	return output, nil
+	return &b.plan, nil
 }
 
-func (c *Calculator) evaluateRPN(rpn []string) (float64, error) {
-	var stack []float64
+// build adds the operations computing node to the plan and returns the
+// operand holding its value.
+func (b *builder) build(node Node, lookup func(n *Name) (Operand, error)) (Operand, error) {
+	switch n := node.(type) {
+	case *Number:
+		if err := checkNumber(n, b.mode); err != nil {
+			return Operand{}, err
+		}
+		return Operand{Value: n.Value, Ref: -1}, nil
+
+	case *Name:
+		if v, ok := constants[n.Name]; ok {
+			return literal(v), nil
+		}
+		return lookup(n)
 
-	for _, token := range rpn {
-		if c.isNumber(token) {
-			num, err := strconv.ParseFloat(token, 64)
+	case *Unary:
+		operand, err := b.build(n.X, lookup)
+		if err != nil {
+			return Operand{}, err
+		}
+		if !operand.IsRef() {
+			// Negated numbers stay literals.
+			operand.Value = negate(operand.Value)
+			return operand, nil
+		}
+		// Agents have no negation, so -x becomes 0-x.
+		return b.add("-", Operand{Value: "0", Ref: -1}, operand), nil
+
+	case *Binary:
+		left, err := b.build(n.X, lookup)
+		if err != nil {
+			return Operand{}, err
+		}
+		right, err := b.build(n.Y, lookup)
+		if err != nil {
+			return Operand{}, err
+		}
+		return b.add(n.Op, left, right), nil
+
+	case *Call:
+		args := make([]Operand, len(n.Args))
+		for i, arg := range n.Args {
+			operand, err := b.build(arg, lookup)
 			if err != nil {
-				return 0, err
+				return Operand{}, err
 			}
-			stack = append(stack, num)
-		} else {
-			if len(stack) < 2 {
-				return 0, fmt.Errorf("invalid expression")
-			}
-			a := stack[len(stack)-2]
-			b := stack[len(stack)-1]
-			stack = stack[:len(stack)-2]
-
-			var result float64
-			switch token {
-			case "+":
-				result = a + b
-			case "-":
-				result = a - b
-			case "*":
-				result = a * b
-			case "/":
-				if b == 0 {
-					return 0, fmt.Errorf("division by zero")
+			args[i] = operand
+		}
+
+		// Long argument lists of associative functions are reduced
+		// pairwise, so that the halves are computed in parallel.
+		if fn, _ := LookupFunction(n.Func); fn.Associative {
+			for len(args) > 2 {
+				var next []Operand
+				for i := 0; i+1 < len(args); i += 2 {
+					next = append(next, b.add(n.Func, args[i], args[i+1]))
 				}
-				result = a / b
-			default:
-				return 0, fmt.Errorf("unknown operator: %s", token)
+				if len(args)%2 == 1 {
+					next = append(next, args[len(args)-1])
+				}
+				args = next
 			}
-			stack = append(stack, result)
 		}
+		if len(args) > 2 {
+			return Operand{}, &Error{Offset: n.Offset, Message: fmt.Sprintf("%s cannot be split into operations", n.Func)}
+		}
+		return b.add(n.Func, args...), nil
 	}
 
-	if len(stack) != 1 {
-		return 0, fmt.Errorf("invalid expression")
-	}
-
-	return stack[0], nil
+	return Operand{}, fmt.Errorf("unexpected node %T", node)
 }
 
-func (c *Calculator) isDigit(s string) bool {
-	return s >= "0" && s <= "9"
+// negate returns the negated number, fraction or complex number.
+func negate(value string) string {
+	if isImaginary(value) {
+		if c, err := ParseComplex(value); err == nil {
+			return formatComplex(-c)
+		}
+	}
+	if v, ok := strings.CutPrefix(value, "-"); ok {
+		return v
+	}
+	return "-" + value
 }
 
-func (c *Calculator) isNumber(s string) bool {
-	_, err := strconv.ParseFloat(s, 64)
-	return err == nil
+// checkNumber reports whether the literal n can be computed in mode:
+// imaginary numbers require ModeComplex.
+func checkNumber(n *Number, mode Mode) error {
+	if isImaginary(n.Value) && mode != ModeComplex {
+		return &Error{Offset: n.Offset, Message: fmt.Sprintf("imaginary number %s requires complex mode", n.Value)}
+	}
+	return nil
 }
 
-func (c *Calculator) isOperator(s string) bool {
-	return s == "+" || s == "-" || s == "*" || s == "/"
+func undefined(n *Name) *Error {
+	return &Error{Offset: n.Offset, Message: fmt.Sprintf("undefined variable %s", n.Name)}
 }
 
-func (c *Calculator) precedence(op string) int {
+func binary(op string, a, b float64) (float64, error) {
 	switch op {
-	case "+", "-":
-		return 1
-	case "*", "/":
-		return 2
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	case "//":
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return math.Floor(a / b), nil
+	case "%":
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return mod(a, b), nil
+	case "^":
+		return math.Pow(a, b), nil
 	default:
-		return 0
+		return 0, fmt.Errorf("unknown operator: %s", op)
+	}
+}
+
+// mod is the remainder of floored division, so that it has the sign of b
+// and a == math.Floor(a/b)*b + mod(a, b), matching the // operator.
+func mod(a, b float64) float64 {
+	r := math.Mod(a, b)
+	if r != 0 && (r < 0) != (b < 0) {
+		r += b
 	}
+	return r
 }
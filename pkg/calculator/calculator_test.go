@@ -0,0 +1,837 @@
+package calculator
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// run decomposes expr and applies its operations in order, as agents do.
+// It returns the value of the expression.
+func run(c *Calculator, expr string, mode Mode) (string, error) {
+	plan, err := c.Decompose(expr, mode, nil)
+	if err != nil {
+		return "", err
+	}
+
+	results := make([]string, len(plan.Operations))
+	value := func(o Operand) string {
+		if o.IsRef() {
+			return results[o.Ref]
+		}
+		return o.Value
+	}
+	for i, op := range plan.Operations {
+		args := make([]string, len(op.Args))
+		for j, arg := range op.Args {
+			args[j] = value(arg)
+		}
+		result, err := Apply(mode, op.Operator, args)
+		if err != nil {
+			return "", err
+		}
+		results[i] = result
+	}
+	return value(plan.Result), nil
+}
+
+// calculate runs expr in float mode.
+func calculate(c *Calculator, expr string) (float64, error) {
+	result, err := run(c, expr, ModeFloat)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(result, 64)
+}
+
+func TestCalculator(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected float64
+		wantErr  bool
+	}{
+		{"simple addition", "2+2", 4, false},
+		{"multiplication before addition", "2+2*2", 6, false},
+		{"with parentheses", "(2+2)*2", 8, false},
+		{"division", "10/2", 5, false},
+		{"decimal", "2.5 + 3.5", 6, false},
+		{"invalid expression", "2 + a", 0, true},
+		{"division by zero", "2/0", 0, true},
+		{"mismatched parentheses", "(2+2", 0, true},
+	}
+
+	c := New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := calculate(c, tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("calculate(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && result != tt.expected {
+				t.Errorf("calculate(%q) = %v, want %v", tt.expr, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUnaryOperators(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected float64
+		wantErr  bool
+	}{
+		{"leading minus", "-5+3", -2, false},
+		{"leading plus", "+5-3", 2, false},
+		{"minus after operator", "2*-3", -6, false},
+		{"plus after operator", "2*+3", 6, false},
+		{"negated parentheses", "(-(2+3))", -5, false},
+		{"double minus", "--4", 4, false},
+		{"mixed signs", "3-+-2", 5, false},
+		{"minus binds tighter than multiplication", "-2*3", -6, false},
+		{"minus after opening parenthesis", "(-2)*(-3)", 6, false},
+		{"operator after operator", "2*/3", 0, true},
+		{"trailing minus", "2-", 0, true},
+		{"only minus", "-", 0, true},
+		{"empty parentheses", "()", 0, true},
+	}
+
+	c := New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := calculate(c, tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("calculate(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && result != tt.expected {
+				t.Errorf("calculate(%q) = %v, want %v", tt.expr, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestImplicitMultiplication(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		enabled  bool
+		expected float64
+		wantErr  bool
+	}{
+		{"number before parentheses", "2(3+4)", true, 14, false},
+		{"parentheses before parentheses", "(1+2)(3+4)", true, 21, false},
+		{"parentheses before number", "(1+2)3", true, 9, false},
+		{"same precedence as multiplication", "8/2(2+2)", true, 16, false},
+		{"after unary minus", "-2(3)", true, -6, false},
+		{"disabled", "2(3+4)", false, 0, true},
+		{"explicit still works when disabled", "2*(3+4)", false, 14, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithImplicitMultiplication(tt.enabled))
+			result, err := calculate(c, tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("calculate(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && result != tt.expected {
+				t.Errorf("calculate(%q) = %v, want %v", tt.expr, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDecomposeUnaryMinus(t *testing.T) {
+	tests := []struct {
+		name       string
+		expr       string
+		operations []Operation
+		result     Operand
+	}{
+		{
+			"negative literal",
+			"-5",
+			nil,
+			Operand{Value: "-5", Ref: -1},
+		},
+		{
+			"negative literal in operation",
+			"2*-3",
+			[]Operation{
+				{Operator: "*", Args: []Operand{{Value: "2", Ref: -1}, {Value: "-3", Ref: -1}}},
+			},
+			Operand{Ref: 0},
+		},
+		{
+			"negated operation",
+			"-(2+3)",
+			[]Operation{
+				{Operator: "+", Args: []Operand{{Value: "2", Ref: -1}, {Value: "3", Ref: -1}}},
+				{Operator: "-", Args: []Operand{{Value: "0", Ref: -1}, {Ref: 0}}},
+			},
+			Operand{Ref: 1},
+		},
+	}
+
+	c := New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := c.Decompose(tt.expr, ModeFloat, nil)
+			if err != nil {
+				t.Fatalf("Decompose(%q) error = %v", tt.expr, err)
+			}
+			if !reflect.DeepEqual(plan.Operations, tt.operations) || plan.Result != tt.result {
+				t.Errorf("Decompose(%q) = %+v, want %+v with result %+v", tt.expr, plan, tt.operations, tt.result)
+			}
+		})
+	}
+}
+
+func TestExtendedOperators(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected float64
+		wantErr  bool
+	}{
+		{"power", "2^10", 1024, false},
+		{"power is right-associative", "2^3^2", 512, false},
+		{"power binds tighter than unary minus", "-2^2", -4, false},
+		{"negative exponent", "2^-1", 0.5, false},
+		{"power before multiplication", "3*2^2", 12, false},
+		{"modulo", "7%3", 1, false},
+		{"modulo takes sign of divisor", "-7%3", 2, false},
+		{"modulo of fractions", "5.5%2", 1.5, false},
+		{"integer division", "7//2", 3, false},
+		{"integer division rounds down", "-7//2", -4, false},
+		{"integer division is left-associative", "100//10//3", 3, false},
+		{"same precedence as multiplication", "2*7//4%3", 0, false},
+		{"modulo by zero", "5%0", 0, true},
+		{"integer division by zero", "5//0", 0, true},
+		{"triple slash", "6///2", 0, true},
+	}
+
+	c := New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := calculate(c, tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("calculate(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && result != tt.expected {
+				t.Errorf("calculate(%q) = %v, want %v", tt.expr, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected float64
+		wantErr  bool
+	}{
+		{"sqrt", "sqrt(16)", 4, false},
+		{"abs", "abs(-3)", 3, false},
+		{"nested calls", "sqrt(abs(-16))+1", 5, false},
+		{"expression argument", "sqrt(3*3+4*4)", 5, false},
+		{"min", "min(3, 1, 2)", 1, false},
+		{"max", "max(3, 1, 2, 7, 5)", 7, false},
+		{"max of one", "max(4)", 4, false},
+		{"sin", "sin(0)", 0, false},
+		{"cos", "cos(0)", 1, false},
+		{"ln", "ln(e)", 1, false},
+		{"log", "log(1000)", 3, false},
+		{"log with base", "log(8, 2)", 3, false},
+		{"pi", "2*pi", 2 * math.Pi, false},
+		{"implicit multiplication", "2pi", 2 * math.Pi, false},
+		{"negated call", "-sqrt(4)", -2, false},
+		{"call in power", "2^max(1,3)", 8, false},
+		{"unknown function", "foo(1)", 0, true},
+		{"undefined variable", "x+1", 0, true},
+		{"too many arguments", "sqrt(1, 2)", 0, true},
+		{"too few arguments", "log()", 0, true},
+		{"missing argument", "min(1,)", 0, true},
+		{"comma outside call", "1,2", 0, true},
+		{"comma in parentheses", "max((1,2))", 0, true},
+		{"unclosed call", "sqrt(4", 0, true},
+		{"square root of negative", "sqrt(-1)", 0, true},
+		{"logarithm of zero", "ln(0)", 0, true},
+	}
+
+	c := New(WithImplicitMultiplication(true))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := calculate(c, tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("calculate(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && math.Abs(result-tt.expected) > 1e-12 {
+				t.Errorf("calculate(%q) = %v, want %v", tt.expr, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDecomposeFunctions(t *testing.T) {
+	lit := func(v string) Operand { return Operand{Value: v, Ref: -1} }
+
+	tests := []struct {
+		name       string
+		expr       string
+		operations []Operation
+		result     Operand
+	}{
+		{
+			"unary function",
+			"sqrt(4)",
+			[]Operation{
+				{Operator: "sqrt", Args: []Operand{lit("4")}},
+			},
+			Operand{Ref: 0},
+		},
+		{
+			"function of two arguments",
+			"log(8,2)",
+			[]Operation{
+				{Operator: "log", Args: []Operand{lit("8"), lit("2")}},
+			},
+			Operand{Ref: 0},
+		},
+		{
+			"variadic function is reduced pairwise",
+			"max(1,2,3,4,5)",
+			[]Operation{
+				{Operator: "max", Args: []Operand{lit("1"), lit("2")}},
+				{Operator: "max", Args: []Operand{lit("3"), lit("4")}},
+				{Operator: "max", Args: []Operand{{Ref: 0}, {Ref: 1}}},
+				{Operator: "max", Args: []Operand{{Ref: 2}, lit("5")}},
+			},
+			Operand{Ref: 3},
+		},
+		{
+			"constant",
+			"pi",
+			nil,
+			lit("3.141592653589793"),
+		},
+	}
+
+	c := New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := c.Decompose(tt.expr, ModeFloat, nil)
+			if err != nil {
+				t.Fatalf("Decompose(%q) error = %v", tt.expr, err)
+			}
+			if !reflect.DeepEqual(plan.Operations, tt.operations) || plan.Result != tt.result {
+				t.Errorf("Decompose(%q) = %+v, want %+v with result %+v", tt.expr, plan, tt.operations, tt.result)
+			}
+		})
+	}
+}
+
+func TestVariables(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected float64
+		wantErr  bool
+	}{
+		{"program", "x = 3; y = x * 2; y + 1", 7, false},
+		{"assignment is the value", "x = 2 + 3", 5, false},
+		{"trailing semicolon", "x = 4; x;", 4, false},
+		{"reassignment", "x = 1; x = x + 1; x * 10", 20, false},
+		{"implicit multiplication", "r = 2; 3r^2", 12, false},
+		{"variable before parenthesis", "k = 3; k(1+1)", 6, false},
+		{"undefined variable", "x = 1; y + 1", 0, true},
+		{"assign to constant", "pi = 3", 0, true},
+		{"assign to function", "sqrt = 3", 0, true},
+		{"invalid name", "2x = 3", 0, true},
+		{"double assignment", "x = y = 3", 0, true},
+		{"missing value", "x =", 0, true},
+		{"empty program", ";", 0, true},
+	}
+
+	c := New(WithImplicitMultiplication(true))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := calculate(c, tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("calculate(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && math.Abs(result-tt.expected) > 1e-12 {
+				t.Errorf("calculate(%q) = %v, want %v", tt.expr, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDecomposeVariables(t *testing.T) {
+	lit := func(v string) Operand { return Operand{Value: v, Ref: -1} }
+
+	tests := []struct {
+		name        string
+		expr        string
+		vars        map[string]string
+		operations  []Operation
+		result      Operand
+		assignments []Assignment
+	}{
+		{
+			"stored variable",
+			"x+1",
+			map[string]string{"x": "2.5"},
+			[]Operation{
+				{Operator: "+", Args: []Operand{lit("2.5"), lit("1")}},
+			},
+			Operand{Ref: 0},
+			nil,
+		},
+		{
+			"literal assignment",
+			"x=3;y=x*2;y+1",
+			nil,
+			[]Operation{
+				{Operator: "*", Args: []Operand{lit("3"), lit("2")}},
+				{Operator: "+", Args: []Operand{{Ref: 0}, lit("1")}},
+			},
+			Operand{Ref: 1},
+			[]Assignment{{Name: "x", Value: lit("3")}, {Name: "y", Value: Operand{Ref: 0}}},
+		},
+		{
+			"variable used twice is computed once",
+			"x=1+2;x*x",
+			nil,
+			[]Operation{
+				{Operator: "+", Args: []Operand{lit("1"), lit("2")}},
+				{Operator: "*", Args: []Operand{{Ref: 0}, {Ref: 0}}},
+			},
+			Operand{Ref: 1},
+			[]Assignment{{Name: "x", Value: Operand{Ref: 0}}},
+		},
+		{
+			"repeated squaring",
+			"x=y+1;x=x*x;x=x*x;x=x*x",
+			map[string]string{"y": "1"},
+			[]Operation{
+				{Operator: "+", Args: []Operand{lit("1"), lit("1")}},
+				{Operator: "*", Args: []Operand{{Ref: 0}, {Ref: 0}}},
+				{Operator: "*", Args: []Operand{{Ref: 1}, {Ref: 1}}},
+				{Operator: "*", Args: []Operand{{Ref: 2}, {Ref: 2}}},
+			},
+			Operand{Ref: 3},
+			[]Assignment{{Name: "x", Value: Operand{Ref: 3}}},
+		},
+		{
+			"value assigned to two variables",
+			"x=1+2;y=x;x+y",
+			nil,
+			[]Operation{
+				{Operator: "+", Args: []Operand{lit("1"), lit("2")}},
+				{Operator: "+", Args: []Operand{{Ref: 0}, {Ref: 0}}},
+			},
+			Operand{Ref: 1},
+			[]Assignment{{Name: "x", Value: Operand{Ref: 0}}, {Name: "y", Value: Operand{Ref: 0}}},
+		},
+		{
+			"only the last assignment is kept",
+			"x=sqrt(2);x=5",
+			nil,
+			[]Operation{
+				{Operator: "sqrt", Args: []Operand{lit("2")}},
+			},
+			lit("5"),
+			[]Assignment{{Name: "x", Value: lit("5")}},
+		},
+		{
+			"program variable shadows stored one",
+			"x=-x;x",
+			map[string]string{"x": "4"},
+			nil,
+			lit("-4"),
+			[]Assignment{{Name: "x", Value: lit("-4")}},
+		},
+	}
+
+	c := New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := c.Decompose(tt.expr, ModeFloat, tt.vars)
+			if err != nil {
+				t.Fatalf("Decompose(%q) error = %v", tt.expr, err)
+			}
+			if !reflect.DeepEqual(plan.Operations, tt.operations) || plan.Result != tt.result ||
+				!reflect.DeepEqual(plan.Assignments, tt.assignments) {
+				t.Errorf("Decompose(%q) = %+v, want %+v with result %+v and assignments %+v",
+					tt.expr, plan, tt.operations, tt.result, tt.assignments)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		offset   int
+		expected string
+		snippet  string
+	}{
+		{"operator instead of operand", ")(+", 0, `number, name or "("`, ")(+\n^"},
+		{"missing operand", "2 + * 3", 4, `number, name or "("`, "2 + * 3\n    ^"},
+		{"unclosed parenthesis", "(2+2", 4, `operator or ")"`, "(2+2\n    ^"},
+		{"extra parenthesis", "2+2)", 3, `operator, ";" or end of expression`, "2+2)\n   ^"},
+		{"two numbers", "1 2", 2, "operator", "1 2\n  ^"},
+		{"missing argument", "min(1,)", 6, `number, name or "("`, "min(1,)\n      ^"},
+		{"unexpected character", "2 # 3", 2, "", "2 # 3\n  ^"},
+		{"malformed number", "1.2.3", 0, "", "1.2.3\n^"},
+		{"wrong number of arguments", "1 + sqrt(1, 2)", 4, "", "1 + sqrt(1, 2)\n    ^"},
+		{"undefined variable", "x = 1; x + y", 11, "", "x = 1; x + y\n           ^"},
+		{"assign to constant", "pi = 3", 0, "", "pi = 3\n^"},
+		{"empty", "  ", 2, "expression", "  \n  ^"},
+	}
+
+	c := New(WithImplicitMultiplication(true))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := calculate(c, tt.expr)
+			var exprErr *Error
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("calculate(%q) error = %v, want *Error", tt.expr, err)
+			}
+			if exprErr.Offset != tt.offset || exprErr.Expected != tt.expected {
+				t.Errorf("calculate(%q) error at %d expecting %q, want at %d expecting %q",
+					tt.expr, exprErr.Offset, exprErr.Expected, tt.offset, tt.expected)
+			}
+			if snippet := exprErr.Snippet(); snippet != tt.snippet {
+				t.Errorf("calculate(%q) snippet = %q, want %q", tt.expr, snippet, tt.snippet)
+			}
+		})
+	}
+}
+
+func TestNestingDepth(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{"parentheses at the limit", strings.Repeat("(", maxDepth-1) + "1" + strings.Repeat(")", maxDepth-1), false},
+		{"long sum", strings.Repeat("1+", 10000) + "1", false},
+		{"nested parentheses", strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000), true},
+		{"nested calls", strings.Repeat("sqrt(", maxDepth) + "1" + strings.Repeat(")", maxDepth), true},
+		{"repeated signs", strings.Repeat("-", 100000) + "1", true},
+		{"tower of powers", strings.Repeat("2^", 100000) + "1", true},
+	}
+
+	c := New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.Decompose(tt.expr, ModeFloat, nil)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("Decompose() error = %v", err)
+				}
+				return
+			}
+			var exprErr *Error
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("Decompose() error = %v, want *Error", err)
+			}
+			if !strings.Contains(exprErr.Message, "nested") {
+				t.Errorf("Decompose() error = %v, want a nesting error", err)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	c := New(WithImplicitMultiplication(true))
+
+	prog, err := c.Parse("r = 2; -2pi r^2")
+	if err != nil {
+		t.Fatalf("Parse error = %v", err)
+	}
+
+	want := &Program{Statements: []Statement{
+		{Name: "r", Value: &Number{Value: "2", Offset: 4}, Offset: 0},
+		{
+			Value: &Binary{
+				Op: "*",
+				X: &Binary{
+					Op:     "*",
+					X:      &Unary{Op: "-", X: &Number{Value: "2", Offset: 8}, Offset: 7},
+					Y:      &Name{Name: "pi", Offset: 9},
+					Offset: 9,
+				},
+				Y: &Binary{
+					Op:     "^",
+					X:      &Name{Name: "r", Offset: 12},
+					Y:      &Number{Value: "2", Offset: 14},
+					Offset: 13,
+				},
+				Offset: 12,
+			},
+			Offset: 7,
+		},
+	}}
+	if !reflect.DeepEqual(prog, want) {
+		t.Errorf("Parse = %+v, want %+v", prog, want)
+	}
+}
+
+func TestDecimalMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected string
+		wantErr  bool
+	}{
+		{"exact sum", "0.1 + 0.2", "0.3", false},
+		{"exact fraction", "1/3*3", "1", false},
+		{"non-terminating", "2/3", "0.66666666666666666667", false},
+		{"floor division", "-7//2", "-4", false},
+		{"remainder", "-7.5%2", "0.5", false},
+		{"integer power", "1.1^2", "1.21", false},
+		{"negative power", "2^-3", "0.125", false},
+		{"fractional power", "4^0.5", "2", false},
+		{"min and max", "max(0.1, 1/3) - min(0.1, 1/3)", "0.23333333333333333333", false},
+		{"function", "sqrt(2.25)", "1.5", false},
+		{"variables", "price = 19.99; price * 3", "59.97", false},
+		{"division by zero", "1/(0.1-0.1)", "", true},
+		{"zero to negative power", "0^-1", "", true},
+		{"huge exponent", "2^100000", "", true},
+		{"power of a power", "((2^10000)^10000)^10000", "", true},
+		{"huge product", "x = 2^10000; y = x*x; z = y*y; w = z*z; w*w", "", true},
+	}
+
+	c := New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := run(c, tt.expr, ModeDecimal)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			result, err := FormatDecimal(value, 20)
+			if err != nil {
+				t.Fatalf("FormatDecimal(%q) error = %v", value, err)
+			}
+			if result != tt.expected {
+				t.Errorf("run(%q) = %s, want %s", tt.expr, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestComplexMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		mode     Mode
+		expected string
+		wantErr  bool
+	}{
+		{"square root of negative", "sqrt(-4)", ModeComplex, "2i", false},
+		{"product", "(1+2i)*(3-i)", ModeComplex, "5+5i", false},
+		{"imaginary unit squared", "i^2", ModeComplex, "-1", false},
+		{"integer power", "(1+2i)^2", ModeComplex, "-3+4i", false},
+		{"division", "(1+2i)/(1-i)", ModeComplex, "-0.5+1.5i", false},
+		{"absolute value", "abs(3+4i)", ModeComplex, "5", false},
+		{"negation", "-(1-2i)", ModeComplex, "-1+2i", false},
+		{"logarithm of negative", "ln(-1)", ModeComplex, "3.141592653589793i", false},
+		{"real expression", "2 + 2 * 2", ModeComplex, "6", false},
+		{"variables", "z = 1+i; z*z", ModeComplex, "2i", false},
+		{"implicit multiplication", "2 i", ModeComplex, "2i", false},
+		{"division by zero", "i/0", ModeComplex, "", true},
+		{"no ordering", "max(i, 1)", ModeComplex, "", true},
+		{"imaginary in float mode", "1+2i", ModeFloat, "", true},
+		{"imaginary in decimal mode", "i", ModeDecimal, "", true},
+		{"complex result in float mode", "sqrt(-4)", ModeFloat, "", true},
+		{"complex power in decimal mode", "(-8)^(1/3)", ModeDecimal, "", true},
+	}
+
+	c := New(WithImplicitMultiplication(true))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := run(c, tt.expr, tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+			if !tt.wantErr && result != tt.expected {
+				t.Errorf("run(%q) = %s, want %s", tt.expr, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestComplexModeRealErrors(t *testing.T) {
+	c := New()
+
+	for _, expr := range []string{"7/0", "7%0", "7//0", "(1+2)%(2-2)"} {
+		if _, err := run(c, expr, ModeComplex); err == nil || err.Error() != "division by zero" {
+			t.Errorf("run(%q) error = %v, want division by zero", expr, err)
+		}
+	}
+	if _, err := run(c, "ln(0)", ModeComplex); err == nil || err.Error() != "logarithm of a non-positive number" {
+		t.Errorf("run(%q) error = %v, want the real error kept", "ln(0)", err)
+	}
+}
+
+func TestDecomposeComplex(t *testing.T) {
+	c := New()
+
+	plan, err := c.Decompose("(1+2i)*(3-i)", ModeComplex, nil)
+	if err != nil {
+		t.Fatalf("Decompose error = %v", err)
+	}
+	want := []Operation{
+		{Operator: "+", Args: []Operand{{Value: "1", Ref: -1}, {Value: "2i", Ref: -1}}},
+		{Operator: "-", Args: []Operand{{Value: "3", Ref: -1}, {Value: "1i", Ref: -1}}},
+		{Operator: "*", Args: []Operand{{Ref: 0}, {Ref: 1}}},
+	}
+	if !reflect.DeepEqual(plan.Operations, want) {
+		t.Errorf("Decompose = %+v, want %+v", plan.Operations, want)
+	}
+
+	for _, expr := range []string{"2i", "z = -2i", "i = 1"} {
+		if _, err := c.Decompose(expr, ModeFloat, nil); err == nil {
+			t.Errorf("Decompose(%q) in float mode: expected error", expr)
+		}
+	}
+	plan, err = c.Decompose("z = 2i", ModeComplex, nil)
+	if err != nil {
+		t.Fatalf("Decompose(%q) error = %v", "z = 2i", err)
+	}
+	if want := []Assignment{{Name: "z", Value: Operand{Value: "2i", Ref: -1}}}; !reflect.DeepEqual(plan.Assignments, want) {
+		t.Errorf("Decompose(%q) assignments = %+v, want %+v", "z = 2i", plan.Assignments, want)
+	}
+}
+
+func TestComplexResultInRealMode(t *testing.T) {
+	c := New()
+
+	for _, expr := range []string{"sqrt(-4)", "ln(-1)", "asin(2)", "(-8)^0.5"} {
+		for _, mode := range []Mode{ModeFloat, ModeDecimal} {
+			_, err := run(c, expr, mode)
+			if err == nil || !strings.Contains(err.Error(), "result is complex; use mode complex") {
+				t.Errorf("run(%q, %s) error = %v, want a complex result error", expr, mode, err)
+			}
+		}
+	}
+
+	if _, err := run(c, "1/0", ModeFloat); err == nil || strings.Contains(err.Error(), "complex") {
+		t.Errorf("run(%q) error = %v, want division by zero", "1/0", err)
+	}
+}
+
+func TestDecomposeVariableModes(t *testing.T) {
+	vars := map[string]string{"x": "1/3", "z": "1+2i"}
+
+	tests := []struct {
+		name    string
+		expr    string
+		mode    Mode
+		result  string
+		wantErr bool
+	}{
+		{"fraction in float mode", "x", ModeFloat, "0.3333333333333333", false},
+		{"fraction in decimal mode", "x", ModeDecimal, "1/3", false},
+		{"fraction in complex mode", "x", ModeComplex, "0.3333333333333333", false},
+		{"complex in complex mode", "-z", ModeComplex, "-1-2i", false},
+		{"complex in float mode", "z", ModeFloat, "", true},
+		{"complex in decimal mode", "z+1", ModeDecimal, "", true},
+		{"unused complex in float mode", "x", ModeFloat, "0.3333333333333333", false},
+	}
+
+	c := New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := c.Decompose(tt.expr, tt.mode, vars)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decompose(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+			if !tt.wantErr && plan.Result.Value != tt.result {
+				t.Errorf("Decompose(%q) result = %+v, want %s", tt.expr, plan.Result, tt.result)
+			}
+		})
+	}
+
+	// A stored fraction keeps decimal mode exact.
+	plan, err := c.Decompose("x*3", ModeDecimal, vars)
+	if err != nil {
+		t.Fatalf("Decompose error = %v", err)
+	}
+	args := make([]string, len(plan.Operations[0].Args))
+	for i, arg := range plan.Operations[0].Args {
+		args[i] = arg.Value
+	}
+	if result, err := Apply(ModeDecimal, plan.Operations[0].Operator, args); err != nil || result != "1" {
+		t.Errorf("x*3 with x = 1/3 = %s, %v, want 1", result, err)
+	}
+}
+
+func TestCheckValue(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"42", false},
+		{"-0.5", false},
+		{".5", false},
+		{"1e+21", false},
+		{"1/3", false},
+		{"-1/3", false},
+		{"-1i", false},
+		{"1+1i", false},
+		{"1e+21-2.5i", false},
+		{"", true},
+		{"NaN", true},
+		{"Inf", true},
+		{"-Inf", true},
+		{"0x10", true},
+		{"1_000", true},
+		{"1e400", true},
+		{"1e-9999999", true},
+		{"1e9999999", true},
+		{"i", true},
+		{"1+i", true},
+		{"1/0", true},
+		{" 1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if err := CheckValue(tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("CheckValue(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
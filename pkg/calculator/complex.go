@@ -0,0 +1,183 @@
+package calculator
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"strconv"
+	"strings"
+)
+
+// imaginaryUnit is the name of the imaginary unit in expressions, so that
+// (1+2i)*(3-i) is a product of complex numbers.
+const imaginaryUnit = "i"
+
+// isImaginary reports whether a literal is an imaginary number such as 2i.
+func isImaginary(value string) bool {
+	return strings.HasSuffix(value, imaginaryUnit)
+}
+
+// complexFunctions are the functions of one argument extended to complex
+// numbers.
+var complexFunctions = map[string]func(complex128) complex128{
+	"abs": func(x complex128) complex128 {
+		return complex(cmplx.Abs(x), 0)
+	},
+	"sqrt": cmplx.Sqrt,
+	"sin":  cmplx.Sin,
+	"cos":  cmplx.Cos,
+	"tan":  cmplx.Tan,
+	"asin": cmplx.Asin,
+	"acos": cmplx.Acos,
+	"atan": cmplx.Atan,
+	"exp":  cmplx.Exp,
+}
+
+// applyComplex computes an operation in ModeComplex. Operations on real
+// arguments that have a real result are computed as in ModeFloat, so that
+// real expressions have the same value in both modes; sqrt(-4) and the
+// like fall back to complex arithmetic.
+func applyComplex(operation string, args []string) (string, error) {
+	values := make([]complex128, len(args))
+	reals := make([]float64, len(args))
+	isReal := true
+	for i, arg := range args {
+		v, err := ParseComplex(arg)
+		if err != nil {
+			return "", fmt.Errorf("invalid argument %d: %w", i+1, err)
+		}
+		values[i] = v
+		reals[i] = real(v)
+		isReal = isReal && imag(v) == 0
+	}
+
+	if fn, ok := LookupFunction(operation); ok {
+		if err := fn.checkArity(len(values)); err != nil {
+			return "", err
+		}
+	} else if len(values) != 2 {
+		return "", fmt.Errorf("operation %s expects 2 arguments, got %d", operation, len(values))
+	}
+
+	// Errors other than a complex result, such as a division by zero, are
+	// kept.
+	if isReal {
+		result, err := applyFloat(operation, reals)
+		if err == nil {
+			return strconv.FormatFloat(result, 'g', -1, 64), nil
+		}
+		if !isComplexResult(operation, reals) {
+			return "", err
+		}
+	}
+
+	result, err := complexOperation(operation, values)
+	if err != nil {
+		return "", err
+	}
+	if cmplx.IsNaN(result) || cmplx.IsInf(result) {
+		return "", fmt.Errorf("result is not a finite number")
+	}
+	return formatComplex(result), nil
+}
+
+func complexOperation(operation string, args []complex128) (complex128, error) {
+	if fn, ok := complexFunctions[operation]; ok {
+		return fn(args[0]), nil
+	}
+
+	switch operation {
+	case "+":
+		return args[0] + args[1], nil
+	case "-":
+		return args[0] - args[1], nil
+	case "*":
+		return args[0] * args[1], nil
+	case "/":
+		if args[1] == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return args[0] / args[1], nil
+	case "^":
+		return complexPower(args[0], args[1])
+	case "ln":
+		if args[0] == 0 {
+			return 0, fmt.Errorf("logarithm of zero")
+		}
+		return cmplx.Log(args[0]), nil
+	case "log":
+		if args[0] == 0 {
+			return 0, fmt.Errorf("logarithm of zero")
+		}
+		if len(args) == 1 {
+			return cmplx.Log10(args[0]), nil
+		}
+		if base := args[1]; base == 0 || base == 1 {
+			return 0, fmt.Errorf("invalid logarithm base")
+		}
+		return cmplx.Log(args[0]) / cmplx.Log(args[1]), nil
+	case "//", "%", "min", "max":
+		// Complex numbers are not ordered.
+		return 0, fmt.Errorf("%s is not defined for complex numbers", operation)
+	default:
+		return 0, fmt.Errorf("unknown operator: %s", operation)
+	}
+}
+
+// complexPower raises base to exponent. Integer powers are computed by
+// repeated multiplication, so that (1+2i)^2 is exactly -3+4i.
+func complexPower(base, exponent complex128) (complex128, error) {
+	n := real(exponent)
+	if imag(exponent) != 0 || n != math.Trunc(n) || math.Abs(n) > maxExponent {
+		return cmplx.Pow(base, exponent), nil
+	}
+	if base == 0 && n < 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+
+	e := int(math.Abs(n))
+	result := complex(1, 0)
+	for ; e > 0; e >>= 1 {
+		if e&1 == 1 {
+			result *= base
+		}
+		base *= base
+	}
+	if n < 0 {
+		result = 1 / result
+	}
+	return result, nil
+}
+
+// ParseComplex converts a value computed in any mode to a complex number.
+// Complex values are written as 1+2i, 2i or, when they are real, as plain
+// numbers.
+func ParseComplex(value string) (complex128, error) {
+	if r, ok := new(big.Rat).SetString(value); ok {
+		f, _ := r.Float64()
+		return complex(f, 0), nil
+	}
+	c, err := strconv.ParseComplex(value, 128)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return c, nil
+}
+
+// formatComplex prints c as ParseComplex reads it: 1+2i, -2i or, for a real
+// number, as in ModeFloat.
+func formatComplex(c complex128) string {
+	re, im := real(c), imag(c)
+	if im == 0 {
+		return strconv.FormatFloat(re, 'g', -1, 64)
+	}
+	s := strconv.FormatFloat(im, 'g', -1, 64) + imaginaryUnit
+	if re == 0 {
+		return s
+	}
+	if im > 0 {
+		s = "+" + s
+	}
+	return strconv.FormatFloat(re, 'g', -1, 64) + s
+}
@@ -0,0 +1,127 @@
+package calculator
+
+import (
+	"fmt"
+	"math"
+)
+
+// Function is a built-in function of the expression language.
+type Function struct {
+	Name    string
+	MinArgs int
+	// MaxArgs is -1 for functions taking any number of arguments.
+	MaxArgs int
+	// Associative functions of many arguments are split into calls of two
+	// arguments each, which agents can compute in parallel.
+	Associative bool
+
+	call func(args []float64) (float64, error)
+}
+
+// Call checks the number of arguments and applies the function.
+func (f Function) Call(args []float64) (float64, error) {
+	if err := f.checkArity(len(args)); err != nil {
+		return 0, err
+	}
+	return f.call(args)
+}
+
+func (f Function) checkArity(n int) error {
+	switch {
+	case f.MinArgs == f.MaxArgs && n != f.MinArgs:
+		return fmt.Errorf("%s expects %d argument(s), got %d", f.Name, f.MinArgs, n)
+	case n < f.MinArgs:
+		return fmt.Errorf("%s expects at least %d argument(s), got %d", f.Name, f.MinArgs, n)
+	case f.MaxArgs >= 0 && n > f.MaxArgs:
+		return fmt.Errorf("%s expects at most %d argument(s), got %d", f.Name, f.MaxArgs, n)
+	}
+	return nil
+}
+
+var functions = map[string]Function{}
+
+// constants are the named values that can be used in expressions.
+var constants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+func init() {
+	unary := func(name string, fn func(float64) (float64, error)) {
+		functions[name] = Function{Name: name, MinArgs: 1, MaxArgs: 1, call: func(args []float64) (float64, error) {
+			return fn(args[0])
+		}}
+	}
+	total := func(fn func(float64) float64) func(float64) (float64, error) {
+		return func(x float64) (float64, error) {
+			return fn(x), nil
+		}
+	}
+
+	unary("abs", total(math.Abs))
+	unary("sin", total(math.Sin))
+	unary("cos", total(math.Cos))
+	unary("tan", total(math.Tan))
+	unary("atan", total(math.Atan))
+	unary("exp", total(math.Exp))
+	unary("sqrt", func(x float64) (float64, error) {
+		if x < 0 {
+			return 0, fmt.Errorf("square root of a negative number")
+		}
+		return math.Sqrt(x), nil
+	})
+	unary("asin", func(x float64) (float64, error) {
+		if x < -1 || x > 1 {
+			return 0, fmt.Errorf("asin argument out of range [-1, 1]")
+		}
+		return math.Asin(x), nil
+	})
+	unary("acos", func(x float64) (float64, error) {
+		if x < -1 || x > 1 {
+			return 0, fmt.Errorf("acos argument out of range [-1, 1]")
+		}
+		return math.Acos(x), nil
+	})
+	unary("ln", func(x float64) (float64, error) {
+		if x <= 0 {
+			return 0, fmt.Errorf("logarithm of a non-positive number")
+		}
+		return math.Log(x), nil
+	})
+
+	// log(x) is the decimal logarithm, log(x, b) the logarithm to base b.
+	functions["log"] = Function{Name: "log", MinArgs: 1, MaxArgs: 2, call: func(args []float64) (float64, error) {
+		if args[0] <= 0 {
+			return 0, fmt.Errorf("logarithm of a non-positive number")
+		}
+		if len(args) == 1 {
+			return math.Log10(args[0]), nil
+		}
+		base := args[1]
+		if base <= 0 || base == 1 {
+			return 0, fmt.Errorf("invalid logarithm base")
+		}
+		return math.Log(args[0]) / math.Log(base), nil
+	}}
+
+	functions["min"] = Function{Name: "min", MinArgs: 1, MaxArgs: -1, Associative: true, call: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, v := range args[1:] {
+			result = math.Min(result, v)
+		}
+		return result, nil
+	}}
+	functions["max"] = Function{Name: "max", MinArgs: 1, MaxArgs: -1, Associative: true, call: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, v := range args[1:] {
+			result = math.Max(result, v)
+		}
+		return result, nil
+	}}
+}
+
+// LookupFunction returns the built-in function with the given name.
+func LookupFunction(name string) (Function, bool) {
+	f, ok := functions[name]
+	return f, ok
+}
@@ -0,0 +1,125 @@
+package calculator
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenName
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenAssign
+	tokenSemicolon
+)
+
+// token is a lexeme of the source starting at byte offset pos.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// String describes the token for error messages.
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenNumber:
+		return "number " + t.text
+	case tokenName:
+		return "name " + t.text
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// tokenize splits src into tokens, the last of which is tokenEOF.
+// Whitespace separates tokens and is otherwise ignored.
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(src); {
+		ch := src[i]
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case isDigit(ch) || ch == '.':
+			j := i
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			if j < len(src) && src[j] == '.' {
+				j++
+				for j < len(src) && isDigit(src[j]) {
+					j++
+				}
+			}
+			if src[i:j] == "." || j < len(src) && src[j] == '.' {
+				return nil, &Error{Offset: i, Message: fmt.Sprintf("malformed number %s", numberPrefix(src[i:]))}
+			}
+			// A number directly followed by i is imaginary, e.g. 2i.
+			if strings.HasPrefix(src[j:], imaginaryUnit) && (j+1 == len(src) || !isLetter(src[j+1]) && !isDigit(src[j+1])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[i:j], pos: i})
+			i = j
+		case isLetter(ch):
+			j := i
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenName, text: src[i:j], pos: i})
+			i = j
+		case strings.HasPrefix(src[i:], "//"):
+			tokens = append(tokens, token{kind: tokenOperator, text: "//", pos: i})
+			i += 2
+		case strings.IndexByte("+-*/%^", ch) >= 0:
+			tokens = append(tokens, token{kind: tokenOperator, text: string(ch), pos: i})
+			i++
+		default:
+			kind, ok := punctuation[ch]
+			if !ok {
+				r, _ := utf8.DecodeRuneInString(src[i:])
+				return nil, &Error{Offset: i, Message: fmt.Sprintf("unexpected character %q", r)}
+			}
+			tokens = append(tokens, token{kind: kind, text: string(ch), pos: i})
+			i++
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+var punctuation = map[byte]tokenKind{
+	'(': tokenLParen,
+	')': tokenRParen,
+	',': tokenComma,
+	'=': tokenAssign,
+	';': tokenSemicolon,
+}
+
+// numberPrefix returns the digits and dots at the start of s.
+func numberPrefix(s string) string {
+	j := 0
+	for j < len(s) && (isDigit(s[j]) || s[j] == '.') {
+		j++
+	}
+	return s[:j]
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isLetter(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b == '_'
+}
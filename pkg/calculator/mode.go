@@ -0,0 +1,331 @@
+package calculator
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Mode selects the arithmetic used to compute an expression.
+type Mode string
+
+const (
+	// ModeFloat computes with float64 numbers.
+	ModeFloat Mode = "float"
+	// ModeDecimal computes exactly with rational numbers, so that
+	// 0.1+0.2 is 0.3. Values are passed between operations as fractions
+	// such as "1/3". Functions other than abs, min and max and powers with
+	// a fractional exponent are computed with float64 precision.
+	ModeDecimal Mode = "decimal"
+	// ModeComplex computes with complex128 numbers, so that sqrt(-4) is 2i.
+	// Values are written as 1+2i; in the other modes imaginary numbers and
+	// complex results are errors.
+	ModeComplex Mode = "complex"
+)
+
+// maxExponent limits integer powers in decimal mode, whose exact results
+// grow with the exponent.
+const maxExponent = 10000
+
+// maxDecimalBits limits the size of the numerator and the denominator of
+// values in decimal mode, so that chains of powers such as
+// ((2^10000)^10000)^10000 fail instead of growing without bound.
+const maxDecimalBits = 1 << 16
+
+// ParseMode returns the mode with the given name; an empty name is ModeFloat.
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case "", ModeFloat:
+		return ModeFloat, nil
+	case ModeDecimal:
+		return ModeDecimal, nil
+	case ModeComplex:
+		return ModeComplex, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q", name)
+	}
+}
+
+// Apply computes an operation of a plan in the given mode. Arguments and
+// the result are numbers formatted as in the plan, fractions in ModeDecimal
+// or complex numbers in ModeComplex.
+func Apply(mode Mode, operation string, args []string) (string, error) {
+	switch mode {
+	case ModeDecimal:
+		return applyDecimal(operation, args)
+	case ModeComplex:
+		return applyComplex(operation, args)
+	}
+
+	values := make([]float64, len(args))
+	for i, arg := range args {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid argument %d: %w", i+1, err)
+		}
+		values[i] = v
+	}
+
+	result, err := applyFloat(operation, values)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(result, 'g', -1, 64), nil
+}
+
+func applyFloat(operation string, args []float64) (float64, error) {
+	var (
+		result float64
+		err    error
+	)
+	if fn, ok := LookupFunction(operation); ok {
+		result, err = fn.Call(args)
+	} else if len(args) != 2 {
+		return 0, fmt.Errorf("operation %s expects 2 arguments, got %d", operation, len(args))
+	} else {
+		result, err = binary(operation, args[0], args[1])
+	}
+	if err == nil && (math.IsNaN(result) || math.IsInf(result, 0)) {
+		err = fmt.Errorf("result is not a finite number")
+	}
+	if err != nil {
+		if isComplexResult(operation, args) {
+			return 0, fmt.Errorf("result is complex; use mode complex")
+		}
+		return 0, err
+	}
+	return result, nil
+}
+
+// isComplexResult reports whether an operation that has no real result,
+// such as sqrt(-4), has a complex one.
+func isComplexResult(operation string, args []float64) bool {
+	values := make([]complex128, len(args))
+	for i, arg := range args {
+		values[i] = complex(arg, 0)
+	}
+	result, err := complexOperation(operation, values)
+	return err == nil && imag(result) != 0 && !cmplx.IsNaN(result) && !cmplx.IsInf(result)
+}
+
+func applyDecimal(operation string, args []string) (string, error) {
+	values := make([]*big.Rat, len(args))
+	for i, arg := range args {
+		v, ok := new(big.Rat).SetString(arg)
+		if !ok {
+			return "", fmt.Errorf("invalid argument %d: %q", i+1, arg)
+		}
+		values[i] = v
+	}
+
+	fn, isFunction := LookupFunction(operation)
+	if isFunction {
+		if err := fn.checkArity(len(values)); err != nil {
+			return "", err
+		}
+	} else if len(values) != 2 {
+		return "", fmt.Errorf("operation %s expects 2 arguments, got %d", operation, len(values))
+	}
+
+	var result *big.Rat
+	switch operation {
+	case "abs":
+		result = new(big.Rat).Abs(values[0])
+	case "min", "max":
+		result = values[0]
+		for _, v := range values[1:] {
+			if c := v.Cmp(result); operation == "min" && c < 0 || operation == "max" && c > 0 {
+				result = v
+			}
+		}
+	case "+":
+		result = new(big.Rat).Add(values[0], values[1])
+	case "-":
+		result = new(big.Rat).Sub(values[0], values[1])
+	case "*":
+		result = new(big.Rat).Mul(values[0], values[1])
+	case "/", "//", "%":
+		a, b := values[0], values[1]
+		if b.Sign() == 0 {
+			return "", fmt.Errorf("division by zero")
+		}
+		result = new(big.Rat).Quo(a, b)
+		if operation == "/" {
+			break
+		}
+		result = floor(result)
+		if operation == "%" {
+			result = new(big.Rat).Sub(a, new(big.Rat).Mul(b, result))
+		}
+	case "^":
+		if values[1].IsInt() {
+			var err error
+			if result, err = power(values[0], values[1]); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if result == nil {
+		// No exact algorithm: compute with float64 and take the result as
+		// the decimal it is printed as.
+		approx := make([]float64, len(values))
+		for i, v := range values {
+			approx[i], _ = v.Float64()
+		}
+		f, err := applyFloat(operation, approx)
+		if err != nil {
+			return "", err
+		}
+		result, _ = new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	if result.Num().BitLen() > maxDecimalBits || result.Denom().BitLen() > maxDecimalBits {
+		return "", fmt.Errorf("result is too large")
+	}
+	return result.RatString(), nil
+}
+
+// convert formats a value computed in any mode as an argument of Apply in
+// the given mode. Complex numbers cannot be converted to the other modes.
+func convert(value string, mode Mode) (string, error) {
+	switch mode {
+	case ModeDecimal:
+		if r, ok := new(big.Rat).SetString(value); ok {
+			return r.RatString(), nil
+		}
+	case ModeComplex:
+		c, err := ParseComplex(value)
+		if err != nil {
+			return "", err
+		}
+		return formatComplex(c), nil
+	}
+
+	f, err := ParseValue(value)
+	if err != nil {
+		if _, complexErr := ParseComplex(value); complexErr == nil {
+			return "", fmt.Errorf("complex value %s requires mode complex", value)
+		}
+		return "", err
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), nil
+}
+
+// floor returns the greatest integer not greater than r.
+func floor(r *big.Rat) *big.Rat {
+	// Euclidean division by the positive denominator rounds down.
+	return new(big.Rat).SetInt(new(big.Int).Div(r.Num(), r.Denom()))
+}
+
+// power raises base to the integer exponent.
+func power(base, exponent *big.Rat) (*big.Rat, error) {
+	n := exponent.Num()
+	if n.CmpAbs(big.NewInt(maxExponent)) > 0 {
+		return nil, fmt.Errorf("exponent %s is too large", n)
+	}
+	if base.Sign() == 0 && n.Sign() < 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+
+	// The result has at least bits-1 bits per unit of the exponent; refuse
+	// it before computing it.
+	e := new(big.Int).Abs(n)
+	if bits := max(base.Num().BitLen(), base.Denom().BitLen()); int64(bits-1)*e.Int64() > maxDecimalBits {
+		return nil, fmt.Errorf("result is too large")
+	}
+
+	num := new(big.Int).Exp(base.Num(), e, nil)
+	den := new(big.Int).Exp(base.Denom(), e, nil)
+	if n.Sign() < 0 {
+		num, den = den, num
+	}
+	return new(big.Rat).SetFrac(num, den), nil
+}
+
+// ParseValue converts a value computed in any mode to the nearest float64.
+// Complex values that are not real numbers are an error.
+func ParseValue(value string) (float64, error) {
+	r, ok := new(big.Rat).SetString(value)
+	if !ok {
+		if _, err := ParseComplex(value); err == nil {
+			return 0, fmt.Errorf("%s is not a real number", value)
+		}
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	f, _ := r.Float64()
+	return f, nil
+}
+
+// valuePattern matches values as Apply formats them in any mode: decimal
+// numbers, fractions such as -1/3 and complex numbers such as 1+2i or -2i.
+var valuePattern = func() *regexp.Regexp {
+	const unsigned = `(?:\d+(?:\.\d*)?|\.\d+)(?:[eE][+-]?\d+)?`
+	const real = `[+-]?` + unsigned
+	return regexp.MustCompile(`^(?:` + real + `|[+-]?\d+/\d+|` + real + `i|` + real + `[+-]` + unsigned + `i)$`)
+}()
+
+// CheckValue reports whether value is a finite number written as Apply
+// writes results. Other notations that ParseValue and ParseComplex accept,
+// such as NaN, Inf, 0x10 or 1_000, are refused. Real values must be exact
+// for ModeDecimal, so exponents that big.Rat refuses, as in 1e-9999999, are
+// refused too.
+func CheckValue(value string) error {
+	if !valuePattern.MatchString(value) {
+		return fmt.Errorf("invalid value %q", value)
+	}
+	if !isImaginary(value) {
+		if _, ok := new(big.Rat).SetString(value); !ok {
+			return fmt.Errorf("invalid value %q", value)
+		}
+	}
+	c, err := ParseComplex(value)
+	if err != nil {
+		return err
+	}
+	if cmplx.IsInf(c) || cmplx.IsNaN(c) {
+		return fmt.Errorf("value %s is not a finite number", value)
+	}
+	return nil
+}
+
+// FormatDecimal prints a value computed in ModeDecimal as a decimal
+// fraction. Values that have no finite decimal representation, such as
+// 1/3, are rounded to the given number of digits after the decimal point.
+func FormatDecimal(value string, digits int) (string, error) {
+	r, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return "", fmt.Errorf("invalid value %q", value)
+	}
+
+	// A fraction is a finite decimal if its denominator has no prime
+	// factors other than 2 and 5; then that many digits are exact.
+	den := new(big.Int).Set(r.Denom())
+	exact := 0
+	for _, p := range []int64{2, 5} {
+		n := 0
+		for m := new(big.Int); ; n++ {
+			q, rem := new(big.Int).QuoRem(den, big.NewInt(p), m)
+			if rem.Sign() != 0 {
+				break
+			}
+			den = q
+		}
+		exact = max(exact, n)
+	}
+	if den.Cmp(big.NewInt(1)) == 0 {
+		digits = exact
+	}
+
+	s := r.FloatString(digits)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return s, nil
+}
@@ -0,0 +1,305 @@
+package calculator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error is an error in an expression, located at a byte offset of its
+// source.
+type Error struct {
+	Offset  int
+	Message string
+	// Expected and Found are set for syntax errors: what the parser
+	// expected at Offset and the token it found there instead.
+	Expected string
+	Found    string
+	Source   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Message, e.Offset)
+}
+
+// Snippet returns the line of the source containing the error with a caret
+// under its position:
+//
+//	2 + * 3
+//	    ^
+func (e *Error) Snippet() string {
+	offset := min(max(e.Offset, 0), len(e.Source))
+	start := strings.LastIndexByte(e.Source[:offset], '\n') + 1
+	end := len(e.Source)
+	if i := strings.IndexByte(e.Source[offset:], '\n'); i >= 0 {
+		end = offset + i
+	}
+
+	// Tabs are kept in the padding so that the caret lines up with them.
+	var pad strings.Builder
+	for _, r := range e.Source[start:offset] {
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+	return e.Source[start:end] + "\n" + pad.String() + "^"
+}
+
+// withSource attaches the source to an *Error, so that it can show a snippet.
+func withSource(err error, src string) error {
+	var e *Error
+	if errors.As(err, &e) {
+		e.Source = src
+	}
+	return err
+}
+
+// precedenceUnary is the precedence of a unary minus, so that -2^2 is
+// -(2^2) but -2*3 is (-2)*3.
+const precedenceUnary = 30
+
+var precedence = map[string]int{
+	"+":  10,
+	"-":  10,
+	"*":  20,
+	"/":  20,
+	"//": 20,
+	"%":  20,
+	"^":  40,
+}
+
+func isRightAssociative(op string) bool {
+	return op == "^"
+}
+
+// maxDepth limits the nesting of parentheses, calls, signs and powers, so
+// that a deeply nested expression cannot exhaust the stack.
+const maxDepth = 200
+
+type parser struct {
+	tokens                 []token
+	pos                    int
+	implicitMultiplication bool
+	// depth is the number of expressions being parsed.
+	depth int
+}
+
+// Parse parses src into a syntax tree. Names are not resolved, so a program
+// referring to undefined variables parses fine. Errors are of type *Error.
+func (c *Calculator) Parse(src string) (*Program, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, withSource(err, src)
+	}
+
+	p := &parser{tokens: tokens, implicitMultiplication: c.implicitMultiplication}
+	prog, err := p.program()
+	if err != nil {
+		return nil, withSource(err, src)
+	}
+	return prog, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// unexpected returns the error for a token found where what was expected.
+func unexpected(what string, found token) *Error {
+	return &Error{
+		Offset:   found.pos,
+		Message:  fmt.Sprintf("expected %s, found %s", what, found),
+		Expected: what,
+		Found:    found.String(),
+	}
+}
+
+// program parses statements separated by ";". Empty statements, such as
+// one after a trailing ";", are skipped.
+func (p *parser) program() (*Program, error) {
+	var prog Program
+	for {
+		for p.peek().kind == tokenSemicolon {
+			p.next()
+		}
+		if p.peek().kind == tokenEOF {
+			break
+		}
+
+		st, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		prog.Statements = append(prog.Statements, st)
+
+		if t := p.peek(); t.kind != tokenSemicolon && t.kind != tokenEOF {
+			return nil, unexpected(`operator, ";" or end of expression`, t)
+		}
+	}
+
+	if len(prog.Statements) == 0 {
+		return nil, unexpected("expression", p.peek())
+	}
+	return &prog, nil
+}
+
+// statement parses "name = expression" or a plain expression.
+func (p *parser) statement() (Statement, error) {
+	t := p.peek()
+	if t.kind != tokenName || p.tokens[p.pos+1].kind != tokenAssign {
+		value, err := p.expression(0)
+		return Statement{Value: value, Offset: t.pos}, err
+	}
+
+	p.next()
+	p.next()
+	if err := CheckVariableName(t.text); err != nil {
+		return Statement{}, &Error{Offset: t.pos, Message: err.Error()}
+	}
+	value, err := p.expression(0)
+	return Statement{Name: t.text, Value: value, Offset: t.pos}, err
+}
+
+// expression parses operators binding tighter than minPrecedence.
+func (p *parser) expression(minPrecedence int) (Node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, &Error{Offset: p.peek().pos, Message: fmt.Sprintf("expression is nested deeper than %d levels", maxDepth)}
+	}
+
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		op := t.text
+		switch t.kind {
+		case tokenOperator:
+		case tokenNumber, tokenName, tokenLParen:
+			// An operand right after another one is multiplied by it.
+			op = "*"
+		default:
+			return left, nil
+		}
+
+		prec := precedence[op]
+		if prec <= minPrecedence {
+			return left, nil
+		}
+		if t.kind == tokenOperator {
+			p.next()
+		} else if err := p.checkImplicitMultiplication(t); err != nil {
+			return nil, err
+		}
+
+		if isRightAssociative(op) {
+			prec--
+		}
+		right, err := p.expression(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: op, X: left, Y: right, Offset: t.pos}
+	}
+}
+
+// checkImplicitMultiplication reports whether the operand t may follow the
+// previous one without an operator. Two numbers in a row never may.
+func (p *parser) checkImplicitMultiplication(t token) error {
+	if !p.implicitMultiplication {
+		return unexpected("operator", t)
+	}
+	if t.kind == tokenNumber && p.tokens[p.pos-1].kind == tokenNumber {
+		return unexpected("operator", t)
+	}
+	return nil
+}
+
+// operand parses a number, name, function call, parenthesized expression or
+// an operand with a unary sign.
+func (p *parser) operand() (Node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenNumber:
+		return &Number{Value: t.text, Offset: t.pos}, nil
+	case tokenName:
+		if t.text == imaginaryUnit {
+			return &Number{Value: "1" + imaginaryUnit, Offset: t.pos}, nil
+		}
+		if _, ok := LookupFunction(t.text); ok && p.peek().kind == tokenLParen {
+			return p.call(t)
+		}
+		// Any other name is a constant or a variable; a parenthesis after
+		// a variable is an implicit multiplication.
+		return &Name{Name: t.text, Offset: t.pos}, nil
+	case tokenLParen:
+		x, err := p.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, unexpected(`operator or ")"`, closing)
+		}
+		return x, nil
+	case tokenOperator:
+		switch t.text {
+		case "+":
+			// Unary plus does not change the operand.
+			return p.expression(precedenceUnary)
+		case "-":
+			x, err := p.expression(precedenceUnary)
+			if err != nil {
+				return nil, err
+			}
+			return &Unary{Op: "-", X: x, Offset: t.pos}, nil
+		}
+	}
+
+	return nil, unexpected(`number, name or "("`, t)
+}
+
+// call parses the arguments of a call of the function name.
+func (p *parser) call(name token) (Node, error) {
+	p.next()
+	call := &Call{Func: name.text, Offset: name.pos}
+
+	if p.peek().kind == tokenRParen {
+		p.next()
+	} else {
+		for {
+			arg, err := p.expression(0)
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, arg)
+
+			t := p.next()
+			if t.kind == tokenRParen {
+				break
+			}
+			if t.kind != tokenComma {
+				return nil, unexpected(`operator, "," or ")"`, t)
+			}
+		}
+	}
+
+	fn, _ := LookupFunction(name.text)
+	if err := fn.checkArity(len(call.Args)); err != nil {
+		return nil, &Error{Offset: name.pos, Message: err.Error()}
+	}
+	return call, nil
+}
@@ -0,0 +1,67 @@
+package calculator
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Assignment stores the value of an operand in a variable.
+type Assignment struct {
+	Name  string
+	Value Operand
+}
+
+// CheckVariableName reports whether a value can be assigned to name: it has
+// to be a name that is not taken by a constant, a function or the imaginary
+// unit.
+func CheckVariableName(name string) error {
+	if name == "" || !isLetter(name[0]) {
+		return fmt.Errorf("invalid variable name: %q", name)
+	}
+	for i := 1; i < len(name); i++ {
+		if !isLetter(name[i]) && !isDigit(name[i]) {
+			return fmt.Errorf("invalid variable name: %q", name)
+		}
+	}
+	if name == imaginaryUnit {
+		return fmt.Errorf("cannot assign to the imaginary unit %s", name)
+	}
+	if _, ok := constants[name]; ok {
+		return fmt.Errorf("cannot assign to constant %s", name)
+	}
+	if _, ok := LookupFunction(name); ok {
+		return fmt.Errorf("cannot assign to function %s", name)
+	}
+	return nil
+}
+
+func literal(v float64) Operand {
+	return Operand{Value: strconv.FormatFloat(v, 'g', -1, 64), Ref: -1}
+}
+
+// builder assembles a plan. The result of an operation may be used by any
+// number of later operations and assigned to any number of variables.
+type builder struct {
+	mode Mode
+	plan Plan
+}
+
+// add appends an operation to the plan and returns the operand referring to
+// its result.
+func (b *builder) add(operator string, args ...Operand) Operand {
+	b.plan.Operations = append(b.plan.Operations, Operation{Operator: operator, Args: args})
+	return Operand{Ref: len(b.plan.Operations) - 1}
+}
+
+// assign records that value is stored in the variable name. Only the last
+// assignment to a variable is kept, so that an earlier value computed later
+// does not overwrite it.
+func (b *builder) assign(name string, value Operand) {
+	for i, a := range b.plan.Assignments {
+		if a.Name == name {
+			b.plan.Assignments = append(b.plan.Assignments[:i], b.plan.Assignments[i+1:]...)
+			break
+		}
+	}
+	b.plan.Assignments = append(b.plan.Assignments, Assignment{Name: name, Value: value})
+}
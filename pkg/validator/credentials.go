@@ -0,0 +1,123 @@
+package validator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CredentialRules configure what logins and passwords are accepted on
+// registration. Zero values disable the corresponding check.
+type CredentialRules struct {
+	LoginMinLength int
+	LoginMaxLength int
+	// LoginPattern is a regular expression the whole login must match.
+	LoginPattern string
+
+	PasswordMinLength     int
+	PasswordMaxLength     int
+	PasswordRequireLower  bool
+	PasswordRequireUpper  bool
+	PasswordRequireDigit  bool
+	PasswordRequireSymbol bool
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// FieldErrors lists every rule a request violates.
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type CredentialsValidator struct {
+	rules        CredentialRules
+	loginPattern *regexp.Regexp
+}
+
+func NewCredentials(rules CredentialRules) (*CredentialsValidator, error) {
+	v := &CredentialsValidator{rules: rules}
+	if rules.LoginPattern != "" {
+		re, err := regexp.Compile("^(?:" + rules.LoginPattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid login pattern: %w", err)
+		}
+		v.loginPattern = re
+	}
+	return v, nil
+}
+
+// Validate returns FieldErrors if login or password break the rules.
+func (v *CredentialsValidator) Validate(login, password string) error {
+	var errs FieldErrors
+	add := func(field, format string, args ...any) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	r := v.rules
+	loginLen := utf8.RuneCountInString(login)
+	switch {
+	case login == "":
+		add("login", "is required")
+	case r.LoginMinLength > 0 && loginLen < r.LoginMinLength:
+		add("login", "must be at least %d characters long", r.LoginMinLength)
+	case r.LoginMaxLength > 0 && loginLen > r.LoginMaxLength:
+		add("login", "must be at most %d characters long", r.LoginMaxLength)
+	}
+	if login != "" && v.loginPattern != nil && !v.loginPattern.MatchString(login) {
+		add("login", "contains characters that are not allowed")
+	}
+
+	// The maximum is in bytes: bcrypt only uses the first 72 bytes.
+	passwordLen := utf8.RuneCountInString(password)
+	switch {
+	case password == "":
+		add("password", "is required")
+	case r.PasswordMinLength > 0 && passwordLen < r.PasswordMinLength:
+		add("password", "must be at least %d characters long", r.PasswordMinLength)
+	case r.PasswordMaxLength > 0 && len(password) > r.PasswordMaxLength:
+		add("password", "must be at most %d bytes long", r.PasswordMaxLength)
+	}
+	if password != "" {
+		var lower, upper, digit, symbol bool
+		for _, c := range password {
+			switch {
+			case unicode.IsLower(c):
+				lower = true
+			case unicode.IsUpper(c):
+				upper = true
+			case unicode.IsDigit(c):
+				digit = true
+			case unicode.IsPunct(c) || unicode.IsSymbol(c):
+				symbol = true
+			}
+		}
+		if r.PasswordRequireLower && !lower {
+			add("password", "must contain a lowercase letter")
+		}
+		if r.PasswordRequireUpper && !upper {
+			add("password", "must contain an uppercase letter")
+		}
+		if r.PasswordRequireDigit && !digit {
+			add("password", "must contain a digit")
+		}
+		if r.PasswordRequireSymbol && !symbol {
+			add("password", "must contain a special character")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package validator
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsValidator(t *testing.T) {
+	rules := CredentialRules{
+		LoginMinLength:       3,
+		LoginMaxLength:       8,
+		LoginPattern:         `[a-z0-9_]+`,
+		PasswordMinLength:    8,
+		PasswordMaxLength:    72,
+		PasswordRequireLower: true,
+		PasswordRequireDigit: true,
+	}
+
+	tests := []struct {
+		name     string
+		rules    *CredentialRules
+		login    string
+		password string
+		want     FieldErrors
+	}{
+		{"valid", nil, "user1", "password123", nil},
+		{"unicode login counted in characters", &CredentialRules{LoginMaxLength: 4}, "юзер", "пароль", nil},
+		{"no rules", &CredentialRules{}, "a", "b", nil},
+		{"empty", nil, "", "", FieldErrors{
+			{"login", "is required"},
+			{"password", "is required"},
+		}},
+		{"short login", nil, "ab", "password123", FieldErrors{
+			{"login", "must be at least 3 characters long"},
+		}},
+		{"long login", nil, "user12345", "password123", FieldErrors{
+			{"login", "must be at most 8 characters long"},
+		}},
+		{"login characters", nil, "User 1", "password123", FieldErrors{
+			{"login", "contains characters that are not allowed"},
+		}},
+		{"short password", nil, "user1", "pass1", FieldErrors{
+			{"password", "must be at least 8 characters long"},
+		}},
+		{"long password", nil, "user1", strings.Repeat("a1", 37), FieldErrors{
+			{"password", "must be at most 72 bytes long"},
+		}},
+		{"password classes", nil, "user1", "PASSWORD", FieldErrors{
+			{"password", "must contain a lowercase letter"},
+			{"password", "must contain a digit"},
+		}},
+		{"upper case and symbols", &CredentialRules{
+			PasswordRequireUpper:  true,
+			PasswordRequireSymbol: true,
+		}, "user1", "password", FieldErrors{
+			{"password", "must contain an uppercase letter"},
+			{"password", "must contain a special character"},
+		}},
+		{"both fields", nil, "ab", "PASSWORD1", FieldErrors{
+			{"login", "must be at least 3 characters long"},
+			{"password", "must contain a lowercase letter"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rules
+			if tt.rules != nil {
+				r = *tt.rules
+			}
+			v, err := NewCredentials(r)
+			if err != nil {
+				t.Fatalf("NewCredentials() error = %v", err)
+			}
+
+			err = v.Validate(tt.login, tt.password)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			var got FieldErrors
+			if !errors.As(err, &got) {
+				t.Fatalf("Validate() error = %v, want FieldErrors", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCredentialsInvalidPattern(t *testing.T) {
+	if _, err := NewCredentials(CredentialRules{LoginPattern: "[a-z"}); err == nil {
+		t.Error("NewCredentials() error = nil, want an error for an invalid pattern")
+	}
+}
+
+func TestFieldErrorsError(t *testing.T) {
+	err := FieldErrors{
+		{"login", "is required"},
+		{"password", "must contain a digit"},
+	}
+	if got, want := err.Error(), "login: is required; password: must contain a digit"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
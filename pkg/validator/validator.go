@@ -2,26 +2,28 @@ package validator
 
 import (
 	"errors"
-	"regexp"
+
+	"github.com/zubrodin/calc-service/pkg/calculator"
 )
 
 var ErrInvalidExpression = errors.New("Expression is not valid")
 
+// Validator checks the syntax of expressions with the parser of the
+// calculator that evaluates them.
 type Validator struct {
-	validExpr *regexp.Regexp
+	calculator *calculator.Calculator
 }
 
-func New() *Validator {
-	// Разрешаем цифры, пробелы, скобки и основные арифметические операции
-	pattern := `^[\d\s\(\)\+\-\*\/\.]+$`
+func New(calc *calculator.Calculator) *Validator {
 	return &Validator{
-		validExpr: regexp.MustCompile(pattern),
+		calculator: calc,
 	}
 }
 
+// Validate returns a *calculator.Error locating the first syntax error of
+// expr. Names are not checked: whether a variable is defined depends on
+// the user.
 func (v *Validator) Validate(expr string) error {
-	if !v.validExpr.MatchString(expr) {
-		return ErrInvalidExpression
-	}
-	return nil
+	_, err := v.calculator.Parse(expr)
+	return err
 }